@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"sentry-picam/raspivid"
+)
+
+type AdaptiveControl struct {
+	Motion *raspivid.Motion
+}
+
+func (ac *AdaptiveControl) handleGetAdaptive(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, ac.Motion.AdaptiveState())
+}
+
+func (ac *AdaptiveControl) handleResetAdaptive(w http.ResponseWriter, r *http.Request) {
+	if err := ac.Motion.ResetAdaptive(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"net/http"
+	"sentry-picam/raspivid"
+)
+
+type ConversionControl struct {
+	Recorder *raspivid.Recorder
+}
+
+// handleConversionQueue lists the recordings being converted and waiting to be converted
+func (cc *ConversionControl) handleConversionQueue(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, cc.Recorder.Queue.Status())
+}
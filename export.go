@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sentry-picam/raspivid"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const maxExportLength = 10 * time.Minute
+
+// exportRequest selects the part of a recording to export, in seconds from its start
+type exportRequest struct {
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+	Precise bool    `json:"precise"` // re-encode to start exactly at Start
+	Overlay bool    `json:"overlay"` // burn in the time of day
+}
+
+// recordingPath returns the path of a recording without its extension, or an empty string
+// if videoID isn't a recording name
+func (rec *RecordingList) recordingPath(videoID string) string {
+	s := strings.Split(videoID, "-")
+	if len(s) < 3 || filepath.Base(videoID) != videoID {
+		return ""
+	}
+	return strings.TrimSuffix(rec.tiers().path(fmt.Sprintf("%s-%s/", s[0], s[1])+videoID+".mp4"), ".mp4")
+}
+
+// handleExportRecording trims a recording to the requested part and downloads it.
+// Both precise and keyframe aligned exports need ffmpeg.
+func (rec *RecordingList) handleExportRecording(w http.ResponseWriter, r *http.Request) {
+	videoID := mux.Vars(r)["videoID"]
+	path := rec.recordingPath(videoID)
+	if path == "" {
+		http.Error(w, "invalid recording name", http.StatusBadRequest)
+		return
+	}
+	// recordings are only kept as mp4 when ffmpeg is available
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		http.Error(w, "exporting requires ffmpeg", http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := os.Stat(path + ".mp4"); err != nil {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	}
+
+	req := exportRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start := time.Duration(req.Start * float64(time.Second))
+	length := time.Duration((req.End - req.Start) * float64(time.Second))
+	if start < 0 || length <= 0 || length > maxExportLength {
+		http.Error(w, "end must be after start, and at most "+maxExportLength.String()+" later", http.StatusBadRequest)
+		return
+	}
+
+	opts := raspivid.TrimOptions{Precise: req.Precise}
+	if req.Overlay {
+		opts.Overlay = recordingStart(path, videoID)
+	}
+
+	f, err := os.CreateTemp("", "sentry-picam-*.mp4")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := raspivid.Trim(path+".mp4", f.Name(), start, length, opts); err != nil {
+		http.Error(w, "export failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_%.0f-%.0fs.mp4\"", videoID, req.Start, req.End))
+	http.ServeFile(w, r, f.Name())
+}
+
+// recordingStart returns when the video of a recording begins, from its metadata if saved
+func recordingStart(path string, videoID string) time.Time {
+	if e, err := raspivid.ReadEvent(path + ".json"); err == nil && !e.ClipStart.IsZero() {
+		return e.ClipStart
+	}
+	if t, err := time.ParseInLocation("2006-01-02-1504_05", videoID, time.Local); err == nil {
+		return t
+	}
+	t, _ := time.ParseInLocation("2006-01-02-1504", videoID, time.Local)
+	return t
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"sentry-picam/raspivid"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type HeatmapControl struct {
+	Motion *raspivid.Motion
+	Folder string
+}
+
+// handleHeatmap returns the triggered block counts for ?date=2006-01-02 (default today),
+// summed over ?days=N ending on that date, optionally limited to ?hour=H.
+// ?format=png renders the counts over the latest thumbnail.
+func (hc *HeatmapControl) handleHeatmap(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	date := time.Now()
+	if q.Get("date") != "" {
+		var err error
+		if date, err = time.ParseInLocation("2006-01-02", q.Get("date"), time.Local); err != nil {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	days := 1
+	if q.Get("days") != "" {
+		var err error
+		if days, err = strconv.Atoi(q.Get("days")); err != nil || days < 1 || days > 366 {
+			http.Error(w, "days must be between 1 and 366", http.StatusBadRequest)
+			return
+		}
+	}
+	hour := -1
+	if q.Get("hour") != "" {
+		var err error
+		if hour, err = strconv.Atoi(q.Get("hour")); err != nil || hour < 0 || hour > 23 {
+			http.Error(w, "hour must be between 0 and 23", http.StatusBadRequest)
+			return
+		}
+	}
+
+	grid := hc.Motion.Heatmap.Get(date, days, hour)
+	if q.Get("format") != "png" {
+		writeJSON(w, grid)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, renderHeatmap(grid, hc.latestThumbnail()))
+}
+
+// latestThumbnail returns the most recent recording thumbnail, or nil if there are none
+func (hc *HeatmapControl) latestThumbnail() image.Image {
+	recordings := getAllFiles(hc.Folder)
+	if len(recordings) == 0 {
+		return nil
+	}
+	sort.Strings(recordings)
+
+	f, err := os.Open(hc.Folder + recordings[len(recordings)-1] + ".jpg")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+// renderHeatmap draws each block's count as a translucent red square over background
+func renderHeatmap(grid raspivid.HeatmapGrid, background image.Image) image.Image {
+	bounds := image.Rect(0, 0, grid.Cols*16, grid.Rows*16)
+	if background != nil {
+		bounds = background.Bounds()
+	}
+
+	out := image.NewRGBA(bounds)
+	if background != nil {
+		draw.Draw(out, bounds, background, bounds.Min, draw.Src)
+	} else {
+		draw.Draw(out, bounds, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	}
+	if grid.Max == 0 || grid.Cols == 0 || grid.Rows == 0 {
+		return out
+	}
+
+	for i, n := range grid.Counts {
+		if n == 0 {
+			continue
+		}
+		x := i % grid.Cols
+		y := i / grid.Cols
+		block := image.Rect(
+			bounds.Min.X+x*bounds.Dx()/grid.Cols, bounds.Min.Y+y*bounds.Dy()/grid.Rows,
+			bounds.Min.X+(x+1)*bounds.Dx()/grid.Cols, bounds.Min.Y+(y+1)*bounds.Dy()/grid.Rows,
+		)
+		alpha := uint8(40 + 180*uint64(n)/uint64(grid.Max))
+		draw.Draw(out, block, image.NewUniform(color.NRGBA{255, 0, 0, alpha}), image.Point{}, draw.Over)
+	}
+	return out
+}
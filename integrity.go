@@ -0,0 +1,15 @@
+package main
+
+import (
+	"net/http"
+	"sentry-picam/raspivid"
+)
+
+type IntegrityControl struct {
+	Recorder *raspivid.Recorder
+}
+
+// handleIntegrityReport shows the results of the integrity check made at startup
+func (ic *IntegrityControl) handleIntegrityReport(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, ic.Recorder.Integrity.Report())
+}
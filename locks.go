@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+)
+
+func (rec *RecordingList) handleListLocks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, rec.Locks.State())
+}
+
+// handleLockRecording protects a recording from automatic deletion
+func (rec *RecordingList) handleLockRecording(w http.ResponseWriter, r *http.Request) {
+	videoID := mux.Vars(r)["videoID"]
+	if rec.recordingPath(videoID) == "" {
+		http.Error(w, "invalid recording name", http.StatusBadRequest)
+		return
+	}
+
+	err := rec.Locks.Lock(videoID)
+	if os.IsNotExist(err) {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, rec.Locks.State())
+}
+
+func (rec *RecordingList) handleUnlockRecording(w http.ResponseWriter, r *http.Request) {
+	if err := rec.Locks.Unlock(mux.Vars(r)["videoID"]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, rec.Locks.State())
+}
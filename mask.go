@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sentry-picam/raspivid"
+
+	"github.com/gorilla/mux"
+)
+
+type MaskControl struct {
+	Motion *raspivid.Motion
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// maskError reports a mask that doesn't exist as 404, and anything else as 500
+func maskError(w http.ResponseWriter, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (mc *MaskControl) handleGetMask(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, mc.Motion.GetMask())
+}
+
+func (mc *MaskControl) handleSetMask(w http.ResponseWriter, r *http.Request) {
+	mask := raspivid.MaskGrid{}
+	if err := json.NewDecoder(r.Body).Decode(&mask); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := mc.Motion.SetMask(mask); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mc.handleGetMask(w, r)
+}
+
+func (mc *MaskControl) handleMaskHistory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, mc.Motion.MaskHistory())
+}
+
+func (mc *MaskControl) handleRestoreMask(w http.ResponseWriter, r *http.Request) {
+	if err := mc.Motion.RestoreMask(mux.Vars(r)["maskID"]); err != nil {
+		maskError(w, err)
+		return
+	}
+	mc.handleGetMask(w, r)
+}
+
+func (mc *MaskControl) handleSavedMasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, mc.Motion.SavedMasks())
+}
+
+// handleSaveMask stores the current mask under {name}
+func (mc *MaskControl) handleSaveMask(w http.ResponseWriter, r *http.Request) {
+	if err := mc.Motion.SaveMask(mux.Vars(r)["name"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (mc *MaskControl) handleApplySavedMask(w http.ResponseWriter, r *http.Request) {
+	if err := mc.Motion.ApplySavedMask(mux.Vars(r)["name"]); err != nil {
+		maskError(w, err)
+		return
+	}
+	mc.handleGetMask(w, r)
+}
+
+func (mc *MaskControl) handleDeleteSavedMask(w http.ResponseWriter, r *http.Request) {
+	if err := mc.Motion.DeleteSavedMask(mux.Vars(r)["name"]); err != nil {
+		maskError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
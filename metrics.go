@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"sentry-picam/raspivid"
+)
+
+type Metrics struct {
+	Motion *raspivid.Motion
+}
+
+func (m *Metrics) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var metrics struct {
+		Motion raspivid.MotionMetrics `json:"motion"`
+	}
+	metrics.Motion = m.Motion.Metrics()
+
+	writeJSON(w, metrics)
+}
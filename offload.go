@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"sentry-picam/raspivid"
+)
+
+type OffloadControl struct {
+	Recorder *raspivid.Recorder
+}
+
+// handleOffloadQueue lists the recordings waiting to be uploaded
+func (oc *OffloadControl) handleOffloadQueue(w http.ResponseWriter, r *http.Request) {
+	if oc.Recorder.Offload == nil {
+		http.Error(w, "offloading is disabled, see -offload", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, oc.Recorder.Offload.Queue())
+}
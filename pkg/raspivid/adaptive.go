@@ -0,0 +1,138 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+const adaptiveSaveInterval = 5 * time.Minute
+
+// AdaptiveModel learns how much motion each block typically has, so areas that are
+// always moving, like a swaying branch, automatically need more motion to trigger
+type AdaptiveModel struct {
+	Rate   float64 // weight of each frame in the learned baseline, 0 disables
+	Margin float64 // agreeing motion vectors above the baseline needed to trigger
+
+	baseline []float64 // typical number of motion vectors agreeing in direction per block
+	lastSave time.Time
+}
+
+// AdaptiveState is the learned baseline and resulting threshold of each motion block
+type AdaptiveState struct {
+	Cols       int       `json:"cols"`
+	Rows       int       `json:"rows"`
+	Baseline   []float64 `json:"baseline"`
+	Thresholds []int     `json:"thresholds"`
+}
+
+// learn updates the baseline of block i and returns its adjusted threshold.
+// detectLock must be held.
+func (c *Motion) learn(i int, mV *mVhelper, threshold int8) int8 {
+	m := &c.Adaptive
+	if m.Rate == 0 || i >= len(m.baseline) {
+		return threshold
+	}
+
+	agreeing := mV.directionScore(1)
+	m.baseline[i] = m.baseline[i]*(1-m.Rate) + agreeing*m.Rate
+
+	return m.threshold(i, threshold, c.BlockWidth*c.BlockWidth)
+}
+
+// threshold returns the threshold of block i, at most maxThreshold or the largest int8
+func (m *AdaptiveModel) threshold(i int, threshold int8, maxThreshold int) int8 {
+	if maxThreshold > math.MaxInt8 {
+		maxThreshold = math.MaxInt8 // blocks 12 or more vectors wide
+	}
+	adjusted := int(math.Ceil(m.baseline[i] + m.Margin))
+	if adjusted > maxThreshold {
+		adjusted = maxThreshold
+	}
+	if adjusted > int(threshold) {
+		return int8(adjusted)
+	}
+	return threshold
+}
+
+func (c *Motion) adaptiveFile() string {
+	return c.RecordingFolder + "adaptiveModel.json"
+}
+
+// initAdaptive loads the previously learned baseline if the grid hasn't changed
+func (c *Motion) initAdaptive() {
+	cols, rows := c.GridSize()
+	c.Adaptive.baseline = make([]float64, cols*rows)
+	c.Adaptive.lastSave = time.Now()
+	if c.Adaptive.Rate == 0 {
+		return
+	}
+
+	f, err := os.ReadFile(c.adaptiveFile())
+	if err != nil {
+		return
+	}
+	state := AdaptiveState{}
+	if err := json.Unmarshal(f, &state); err != nil || state.Cols != cols || state.Rows != rows || len(state.Baseline) != cols*rows {
+		log.Println("Couldn't load learned motion baseline, starting over")
+		return
+	}
+	c.Adaptive.baseline = state.Baseline
+	log.Println("Learned motion baseline loaded")
+}
+
+// saveAdaptive periodically persists the learned baseline. detectLock must not be held.
+func (c *Motion) saveAdaptive() {
+	if c.Adaptive.Rate == 0 || time.Since(c.Adaptive.lastSave) < adaptiveSaveInterval {
+		return
+	}
+	c.Adaptive.lastSave = time.Now()
+
+	out, err := json.Marshal(c.AdaptiveState())
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(c.adaptiveFile(), out, 0600); err != nil {
+		log.Println("Couldn't save learned motion baseline: " + err.Error())
+	}
+}
+
+// AdaptiveState returns the learned baseline of each block with its resulting threshold
+func (c *Motion) AdaptiveState() AdaptiveState {
+	cols, rows := c.GridSize()
+
+	c.detectLock.Lock()
+	defer c.detectLock.Unlock()
+
+	state := AdaptiveState{
+		Cols:       cols,
+		Rows:       rows,
+		Baseline:   append([]float64{}, c.Adaptive.baseline...),
+		Thresholds: make([]int, len(c.Adaptive.baseline)),
+	}
+	for i := range state.Thresholds {
+		threshold := c.blockThreshold(i)
+		if c.Adaptive.Rate > 0 {
+			threshold = c.Adaptive.threshold(i, threshold, c.BlockWidth*c.BlockWidth)
+		}
+		state.Thresholds[i] = int(threshold)
+	}
+	return state
+}
+
+// ResetAdaptive forgets the learned baseline
+func (c *Motion) ResetAdaptive() error {
+	c.detectLock.Lock()
+	for i := range c.Adaptive.baseline {
+		c.Adaptive.baseline[i] = 0
+	}
+	c.detectLock.Unlock()
+
+	err := os.Remove(c.adaptiveFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
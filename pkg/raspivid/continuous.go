@@ -0,0 +1,180 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sentry-picam/broker"
+	"strings"
+	"time"
+)
+
+// ContinuousFolder holds continuously recorded segments, in a subfolder per day
+const ContinuousFolder = "continuous/"
+
+const segmentNameFormat = "2006-01-02-1504_05"
+
+// Interval is a span of time within a segment
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Segment describes a continuously recorded file. It's saved next to the segment as name.json
+type Segment struct {
+	Name   string     `json:"name"`
+	Start  time.Time  `json:"start"`
+	End    time.Time  `json:"end"`
+	Motion []Interval `json:"motion"` // motion events within the segment, including their post-roll
+}
+
+// ReadSegment loads the metadata saved for a segment
+func ReadSegment(file string) (Segment, error) {
+	s := Segment{}
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(f, &s)
+	return s, err
+}
+
+func writeSegment(file string, s Segment) error {
+	out, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, out, 0644)
+}
+
+// segmentDayFolder returns the day folder a segment is stored in
+func segmentDayFolder(folder string, name string) string {
+	return folder + name[:len("2006-01-02")] + "/"
+}
+
+// storeSegment moves a finished segment from raw/ to its day folder, converting it to mp4 if possible
+func (rec *Recorder) storeSegment(folder string, s Segment, framerate int) {
+	dayFolder := segmentDayFolder(folder, s.Name)
+	os.MkdirAll(dayFolder, 0700)
+
+	raw := folder + "raw/" + s.Name + ".h264"
+	stored := true
+	if rec.hasFfmpeg && remux(framerate, raw, dayFolder+s.Name+".mp4") == nil {
+		os.Remove(raw)
+	} else if err := os.Rename(raw, dayFolder+s.Name+".h264"); err != nil {
+		log.Println("Couldn't store segment: " + err.Error())
+		stored = false
+	}
+
+	if err := writeSegment(dayFolder+s.Name+".json", s); err != nil {
+		log.Println(err)
+	}
+	os.Remove(folder + "raw/" + s.Name + ".json")
+
+	if stored && rec.Offload != nil {
+		rec.Offload.Enqueue(ContinuousFolder+s.Name[:len("2006-01-02")]+"/", s.Name)
+	}
+}
+
+// storeLeftoverSegments stores segments left in raw/ by an interrupted run
+func (rec *Recorder) storeLeftoverSegments(folder string, framerate int) {
+	files, err := os.ReadDir(folder + "raw/")
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".h264" {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), ".h264")
+		start, err := time.ParseInLocation(segmentNameFormat, name, time.Local)
+		if err != nil {
+			continue
+		}
+
+		s, err := ReadSegment(folder + "raw/" + name + ".json")
+		if err != nil {
+			s = Segment{Name: name, Start: start, End: start}
+			if info, err := f.Info(); err == nil {
+				s.End = info.ModTime()
+			}
+		}
+		rec.storeSegment(folder, s, framerate)
+	}
+}
+
+// segmentSlot returns the start of the segment t falls in. Segments are counted from local
+// midnight by the wall clock, so 15 minute segments start on the quarter hour in any time zone.
+func segmentSlot(t time.Time, length time.Duration) time.Time {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	slot := sinceMidnight / length * length
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(slot)
+}
+
+// RecordContinuous records the video stream around the clock into segments of
+// SegmentLength, aligned to the clock and starting on keyframes. Motion events are
+// marked in each segment's metadata. folderpath must include the trailing slash.
+func (rec *Recorder) RecordContinuous(caster *broker.Broker, folderpath string, framerate int) {
+	folder := folderpath + ContinuousFolder
+	os.MkdirAll(folder+"raw/", 0700)
+	rec.Integrity.checkRaw(folderpath, folder+"raw/", rawLeftovers(folder+"raw/"))
+	rec.storeLeftoverSegments(folder, framerate)
+
+	stream := caster.Subscribe()
+	defer caster.Unsubscribe(stream)
+
+	var f *os.File
+	var seg Segment
+	inMotion := false
+	for {
+		x := <-stream
+		packet := x.([]byte)
+		now := time.Now()
+		isSPS := packet[4] == 39
+
+		if isSPS && (f == nil || !segmentSlot(now, rec.SegmentLength).Equal(segmentSlot(seg.Start, rec.SegmentLength))) {
+			if f != nil {
+				f.Close()
+				seg.End = now
+				if inMotion {
+					seg.Motion[len(seg.Motion)-1].End = now
+				}
+				writeSegment(folder+"raw/"+seg.Name+".json", seg)
+				go func(s Segment) {
+					rec.storeSegment(folder, s, framerate)
+					rec.Maintenance(folderpath)
+				}(seg)
+			}
+
+			seg = Segment{Name: now.Format(segmentNameFormat), Start: now, Motion: []Interval{}}
+			var err error
+			f, err = os.Create(folder + "raw/" + seg.Name + ".h264")
+			if err != nil {
+				log.Println("Couldn't start segment: " + err.Error())
+				f = nil
+			} else if inMotion {
+				seg.Motion = append(seg.Motion, Interval{Start: now})
+			}
+		}
+		if f == nil {
+			continue
+		}
+
+		active := now.Before(rec.StopTime)
+		if active && !inMotion {
+			seg.Motion = append(seg.Motion, Interval{Start: now})
+		} else if !active && inMotion {
+			seg.Motion[len(seg.Motion)-1].End = now
+		}
+		inMotion = active
+
+		if _, err := f.Write(packet); err != nil {
+			log.Println("Couldn't write segment: " + err.Error())
+			f.Close()
+			f = nil
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package raspivid
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSegmentSlot(t *testing.T) {
+	india := time.FixedZone("IST", 5*3600+1800)
+	tests := []struct {
+		t      time.Time
+		length time.Duration
+		want   time.Time
+	}{
+		{time.Date(2026, 10, 19, 14, 7, 3, 0, time.UTC), 5 * time.Minute, time.Date(2026, 10, 19, 14, 5, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 19, 14, 5, 0, 0, time.UTC), 5 * time.Minute, time.Date(2026, 10, 19, 14, 5, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 19, 14, 4, 59, 999999999, time.UTC), 5 * time.Minute, time.Date(2026, 10, 19, 14, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 19, 23, 59, 59, 0, time.UTC), time.Hour, time.Date(2026, 10, 19, 23, 0, 0, 0, time.UTC)},
+		// 7 hour segments restart at midnight, so the last one of the day is shorter
+		{time.Date(2026, 10, 19, 23, 59, 0, 0, time.UTC), 7 * time.Hour, time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 20, 0, 30, 0, 0, time.UTC), 7 * time.Hour, time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+		// aligned to the local hour, where truncating since the epoch gives half past
+		{time.Date(2026, 10, 19, 10, 20, 0, 0, india), time.Hour, time.Date(2026, 10, 19, 10, 0, 0, 0, india)},
+		{time.Date(2026, 10, 19, 10, 59, 59, 0, india), 15 * time.Minute, time.Date(2026, 10, 19, 10, 45, 0, 0, india)},
+	}
+	for _, tt := range tests {
+		if got := segmentSlot(tt.t, tt.length); !got.Equal(tt.want) {
+			t.Errorf("segmentSlot(%v, %v) = %v, want %v", tt.t, tt.length, got, tt.want)
+		}
+	}
+}
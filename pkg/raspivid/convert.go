@@ -5,59 +5,119 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type Converter struct {
-	Framerate      int
-	TriggerScript  string
-	highlightCache map[string]float64
-	recorder       *Recorder
-	folder         string
+	Framerate     int
+	TriggerScript string
+	recorder      *Recorder
+	folder        string
 }
 
-func (conv *Converter) CacheItem(filename string, time float64) {
-	conv.highlightCache[filename] = time
-}
-
-func (conv *Converter) convertFile(name string) {
-	s := strings.Split(name, "-")
-	newFolder := fmt.Sprintf("%s/%s-%s/", conv.folder, s[0], s[1])
-	os.MkdirAll(newFolder, 0777)
-
+// remux copies a raw h264 stream into an mp4 container
+func remux(framerate int, src string, dst string) error {
 	cmd := exec.Command("nice", "-19",
 		"ffmpeg", "-y",
-		"-framerate", strconv.Itoa(conv.Framerate),
-		"-i", conv.folder+"raw/"+name+".h264",
+		"-framerate", strconv.Itoa(framerate),
+		"-i", src,
 		"-c", "copy",
-		newFolder+name+".mp4",
+		dst,
 	)
-	cmd.Run()
+	return runFfmpeg(cmd)
+}
+
+// runFfmpeg runs an ffmpeg command, adding the last lines it printed to the error if it fails
+func runFfmpeg(cmd *exec.Cmd) error {
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) > 3 {
+		lines = lines[len(lines)-3:]
+	}
+	return fmt.Errorf("%v: %s", err, strings.Join(lines, "; "))
+}
 
-	skip, ok := conv.highlightCache[name]
-	if !ok {
-		skip = 3
+// TrimOptions control how a clip is trimmed
+type TrimOptions struct {
+	Precise bool      // re-encode to start exactly at start instead of the keyframe before it
+	Overlay time.Time // burn in a timestamp counting from this time, zero for none. Implies Precise.
+}
+
+// Trim copies length of an mp4 from start into a new mp4. Unless re-encoded, the copy
+// begins on the keyframe at or before start.
+func Trim(src string, dst string, start time.Duration, length time.Duration, opts TrimOptions) error {
+	args := []string{"-19",
+		"ffmpeg", "-y",
+		"-ss", fmt.Sprintf("%f", start.Seconds()),
+		"-i", src,
+		"-t", fmt.Sprintf("%f", length.Seconds()),
 	}
-	cmd = exec.Command("nice", "-19",
+	if !opts.Overlay.IsZero() {
+		args = append(args, "-vf", fmt.Sprintf(
+			"drawtext=text='%%{pts\\:localtime\\:%d}':x=8:y=8:fontsize=24:fontcolor=white:box=1:boxcolor=black@0.5",
+			opts.Overlay.Add(start).Unix()))
+	}
+	if opts.Precise || !opts.Overlay.IsZero() {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-an")
+	} else {
+		args = append(args, "-c", "copy")
+	}
+	args = append(args, "-movflags", "+faststart", dst)
+
+	return runFfmpeg(exec.Command("nice", args...))
+}
+
+// makeThumbnail saves the frame skip seconds into a video as a jpg
+func makeThumbnail(video string, jpg string, skip float64) error {
+	cmd := exec.Command("nice", "-19",
 		"ffmpeg", "-y",
 		"-ss", fmt.Sprintf("%f", skip),
-		"-i", newFolder+name+".mp4",
+		"-i", video,
 		"-vf", "scale=600:-1",
 		"-qscale:v", "16",
 		"-frames:v", "1",
-		newFolder+name+".jpg",
+		jpg,
 	)
-	cmd.Run()
-	delete(conv.highlightCache, name)
+	return runFfmpeg(cmd)
+}
 
-	os.Remove(conv.folder + "raw/" + name + ".h264")
+// convertFile moves a finished recording out of raw/, with its thumbnail taken skip seconds in
+func (conv *Converter) convertFile(name string, skip float64) {
+	s := strings.Split(name, "-")
+	newFolder := fmt.Sprintf("%s/%s-%s/", conv.folder, s[0], s[1])
+	os.MkdirAll(newFolder, 0777)
+
+	raw := conv.folder + "raw/" + name + ".h264"
+
+	if conv.recorder.hasFfmpeg && remux(conv.Framerate, raw, newFolder+name+".mp4") == nil {
+		if makeThumbnail(newFolder+name+".mp4", newFolder+name+".jpg", skip) != nil {
+			keyframeThumbnail(raw, newFolder+name+".jpg", skip, conv.Framerate)
+		}
+		os.Remove(raw)
+	} else {
+		if err := keyframeThumbnail(raw, newFolder+name+".jpg", skip, conv.Framerate); err != nil {
+			log.Println("Couldn't create thumbnail for " + name + ": " + err.Error())
+		}
+		if err := os.Rename(raw, newFolder+name+".h264"); err != nil {
+			log.Println("Couldn't store recording: " + err.Error())
+		}
+	}
+	os.Rename(conv.folder+"raw/"+name+".json", newFolder+name+".json")
+	if conv.recorder.hasFfmpeg {
+		conv.makeThumbnailSet(newFolder, name)
+	}
 	//log.Println("File written: ", name, "Offset:", skip)
+	if conv.recorder.Offload != nil {
+		conv.recorder.Offload.Enqueue(dayFolder(name), name)
+	}
 
 	if conv.TriggerScript != "" {
-		cmd = exec.Command("nice", "-19",
+		cmd := exec.Command("nice", "-19",
 			conv.TriggerScript, name,
 		)
 		err := cmd.Start()
@@ -67,33 +127,7 @@ func (conv *Converter) convertFile(name string) {
 	}
 }
 
-func (conv *Converter) convertFolder(folder string) {
-	files, err := os.ReadDir(folder + "raw/")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	for _, f := range files {
-		extension := filepath.Ext(strings.ToLower(f.Name()))
-		name := strings.TrimSuffix(filepath.Base(f.Name()), filepath.Ext(f.Name()))
-
-		if extension == ".h264" {
-			conv.convertFile(name)
-		}
-	}
-}
-
 func (conv *Converter) Init(rec *Recorder, folder string) {
 	conv.recorder = rec
 	conv.folder = folder
-	conv.highlightCache = make(map[string]float64)
-}
-
-func (conv *Converter) Start(rec *Recorder, folder string) {
-	for {
-		if time.Now().After(rec.StopTime) {
-			conv.convertFolder(folder)
-		}
-		time.Sleep(5 * time.Second)
-	}
 }
@@ -0,0 +1,93 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// EventInfo describes the motion behind a recording. It's saved next to the clip as name.json
+type EventInfo struct {
+	Name      string    `json:"name"`
+	ClipStart time.Time `json:"clipStart"` // start of the video, up to the pre-roll before Start
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Cols      int       `json:"cols"` // motion block grid used by tracks
+	Rows      int       `json:"rows"`
+
+	Event    string `json:"event"`    // name of the first part, shared by all parts of an event
+	Part     int    `json:"part"`     // long events are split into consecutive files, starting from 1
+	Previous string `json:"previous"` // name of the previous part
+	Next     string `json:"next"`     // name of the next part
+
+	Filter                MotionFilter `json:"filter"`
+	MaxObjectSize         int          `json:"maxObjectSize"` // largest group of adjacent triggered blocks
+	MaxArea               float64      `json:"maxArea"`       // largest fraction of triggered blocks
+	TriggerFrames         int          `json:"triggerFrames"` // frames that passed the filters
+	RejectedTooSmall      int          `json:"rejectedTooSmall"`
+	RejectedTooLarge      int          `json:"rejectedTooLarge"`
+	RejectedNotPersistent int          `json:"rejectedNotPersistent"`
+
+	Tracks    []Track    `json:"tracks"`
+	Crossings []Crossing `json:"crossings"`
+
+	Thumbnails ThumbnailSet `json:"thumbnails"`
+}
+
+// ReadEvent loads the metadata saved for a recording
+func ReadEvent(file string) (EventInfo, error) {
+	e := EventInfo{}
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return e, err
+	}
+	err = json.Unmarshal(f, &e)
+	return e, err
+}
+
+// WriteEvent saves the metadata of a recording
+func WriteEvent(file string, e EventInfo) error {
+	out, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, out, 0644)
+}
+
+// updateEvent modifies the metadata of the ongoing motion event
+func (rec *Recorder) updateEvent(fn func(e *EventInfo)) {
+	rec.eventLock.Lock()
+	defer rec.eventLock.Unlock()
+
+	fn(&rec.event)
+}
+
+// takePart returns the metadata of the ongoing motion event for the part of it saved as
+// name, and clears what was counted so the next part only reports its own motion
+func (rec *Recorder) takePart(name string) EventInfo {
+	rec.eventLock.Lock()
+	defer rec.eventLock.Unlock()
+
+	e := rec.event
+	if e.Event == "" {
+		e.Event = name
+	}
+	rec.event = EventInfo{
+		Event:  e.Event,
+		Start:  time.Now(),
+		Cols:   e.Cols,
+		Rows:   e.Rows,
+		Filter: e.Filter,
+	}
+	return e
+}
+
+// takeEvent returns the metadata of the ongoing motion event and starts a new one
+func (rec *Recorder) takeEvent() EventInfo {
+	rec.eventLock.Lock()
+	defer rec.eventLock.Unlock()
+
+	e := rec.event
+	rec.event = EventInfo{}
+	return e
+}
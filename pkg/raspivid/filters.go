@@ -0,0 +1,145 @@
+package raspivid
+
+import "time"
+
+// MotionFilter rejects motion unlikely to be worth recording, like leaves, insects,
+// and whole-frame exposure changes
+type MotionFilter struct {
+	MinObjectSize int     `json:"minObjectSize"` // minimum connected triggered blocks
+	PersistFrames int     `json:"persistFrames"` // frames out of PersistWindow that must pass
+	PersistWindow int     `json:"persistWindow"`
+	MaxArea       float64 `json:"maxArea"` // maximum fraction of triggered blocks, 0 disables
+
+	history  []bool // recent frames that passed the size and area filters
+	historyI int
+}
+
+// filter rejection reasons
+const (
+	filterPassed = iota
+	filterTooSmall
+	filterTooLarge
+	filterNotPersistent
+)
+
+func (f *MotionFilter) init() {
+	if f.MinObjectSize < 1 {
+		f.MinObjectSize = 1
+	}
+	if f.PersistWindow < 1 {
+		f.PersistWindow = 1
+	}
+	if f.PersistFrames < 1 {
+		f.PersistFrames = 1
+	}
+	if f.PersistFrames > f.PersistWindow {
+		f.PersistWindow = f.PersistFrames
+	}
+
+	f.history = make([]bool, f.PersistWindow)
+	f.historyI = 0
+}
+
+// check runs the frame through the filters, returning the rejection reason,
+// largest object size, and fraction of triggered blocks
+func (f *MotionFilter) check(frame *[]motionVector, blobs []blob) (result int, objectSize int, area float64) {
+	triggered := 0
+	for _, bl := range blobs {
+		triggered += bl.size
+		if bl.size > objectSize {
+			objectSize = bl.size
+		}
+	}
+
+	result = filterPassed
+	if triggered > 0 {
+		area = float64(triggered) / float64(len(*frame))
+	}
+	if triggered == 0 || objectSize < f.MinObjectSize {
+		result = filterTooSmall
+	} else if f.MaxArea > 0 && area > f.MaxArea {
+		result = filterTooLarge
+	}
+
+	f.history[f.historyI] = result == filterPassed
+	f.historyI = (f.historyI + 1) % len(f.history)
+
+	if result == filterPassed {
+		passed := 0
+		for _, v := range f.history {
+			if v {
+				passed++
+			}
+		}
+		if passed < f.PersistFrames {
+			result = filterNotPersistent
+		}
+	}
+	return result, objectSize, area
+}
+
+// newEventInfo starts the metadata of a motion event
+func (c *Motion) newEventInfo() EventInfo {
+	cols, rows := c.GridSize()
+	return EventInfo{
+		Start: time.Now(),
+		Cols:  cols,
+		Rows:  rows,
+		Filter: MotionFilter{
+			MinObjectSize: c.Filter.MinObjectSize,
+			PersistFrames: c.Filter.PersistFrames,
+			PersistWindow: c.Filter.PersistWindow,
+			MaxArea:       c.Filter.MaxArea,
+		},
+	}
+}
+
+// passesFilters runs a frame through Filter and tracks the outcome in the event metadata
+func (c *Motion) passesFilters(frame *[]motionVector, blobs []blob) bool {
+	result, objectSize, area := c.Filter.check(frame, blobs)
+
+	newEvent := time.Now().After(c.recorder.StopTime)
+	if newEvent && result != filterPassed {
+		return false // only report rejections during an event
+	}
+
+	c.recorder.updateEvent(func(e *EventInfo) {
+		if newEvent {
+			*e = c.newEventInfo()
+		}
+
+		switch result {
+		case filterPassed:
+			e.TriggerFrames++
+		case filterTooSmall:
+			if objectSize > 0 {
+				e.RejectedTooSmall++
+			}
+		case filterTooLarge:
+			e.RejectedTooLarge++
+		case filterNotPersistent:
+			e.RejectedNotPersistent++
+		}
+		if objectSize > e.MaxObjectSize {
+			e.MaxObjectSize = objectSize
+		}
+		if area > e.MaxArea {
+			e.MaxArea = area
+		}
+	})
+	return result == filterPassed
+}
+
+// recordTracks adds tracks that ended during the ongoing event to its metadata
+func (c *Motion) recordTracks(tracks []Track) {
+	for _, t := range tracks {
+		if len(t.Path) < 2 {
+			continue
+		}
+		c.recorder.updateEvent(func(e *EventInfo) {
+			if !e.Start.IsZero() && t.Path[len(t.Path)-1].T.After(e.Start) {
+				e.Tracks = append(e.Tracks, t)
+			}
+		})
+	}
+}
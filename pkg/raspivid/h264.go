@@ -0,0 +1,1491 @@
+package raspivid
+
+import (
+	"errors"
+	"image"
+)
+
+// A decoder for intra coded pictures of baseline H.264, enough to make thumbnails of
+// keyframes without ffmpeg. It supports what the camera produces: CAVLC, 4:2:0, 8 bit
+// progressive frames, without slice groups or scaling matrices.
+
+var errUnsupportedStream = errors.New("unsupported H.264 stream")
+var errCorruptStream = errors.New("corrupt H.264 stream")
+
+// NAL unit types
+const (
+	nalSlice    = 1
+	nalIDRSlice = 5
+	nalSPS      = 7
+	nalPPS      = 8
+)
+
+// bitReader reads the RBSP of a NAL unit
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	end  int // position of the stop bit
+}
+
+func newBitReader(nal []byte) *bitReader {
+	// remove emulation prevention bytes
+	data := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		data = append(data, b)
+	}
+
+	end := len(data) * 8
+	for end > 0 && data[(end-1)/8]&(1<<uint(7-(end-1)%8)) == 0 {
+		end--
+	}
+	return &bitReader{data: data, end: end - 1}
+}
+
+func (b *bitReader) peek(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if p := b.pos + i; p>>3 < len(b.data) {
+			v |= int(b.data[p>>3]>>uint(7-p&7)) & 1
+		}
+	}
+	return v
+}
+
+func (b *bitReader) u(n int) int {
+	v := b.peek(n)
+	b.pos += n
+	return v
+}
+
+func (b *bitReader) flag() bool {
+	return b.u(1) == 1
+}
+
+// ue reads an unsigned Exp-Golomb code. Codes too long to fit in 31 bits mark the reader
+// as overrun, so the result is never negative, even where int is 32 bits.
+func (b *bitReader) ue() int {
+	zeros := 0
+	for b.u(1) == 0 {
+		zeros++
+		if zeros > 30 || b.pos > b.end {
+			b.pos = b.end + 1
+			return 0
+		}
+	}
+	return 1<<uint(zeros) - 1 + b.u(zeros)
+}
+
+func (b *bitReader) se() int {
+	v := b.ue()
+	if v&1 == 1 {
+		return (v + 1) / 2
+	}
+	return -v / 2
+}
+
+func (b *bitReader) moreData() bool {
+	return b.pos < b.end
+}
+
+func (b *bitReader) overrun() bool {
+	return b.pos > b.end
+}
+
+type h264SPS struct {
+	widthMbs, heightMbs      int
+	log2MaxFrameNum          int
+	pocType                  int
+	log2MaxPocLsb            int
+	deltaPicOrderAlwaysZero  bool
+	cropLeft, cropRight      int // luma samples
+	cropTop, cropBottom      int
+	profileIdc, chromaFormat int
+}
+
+func parseSPS(nal []byte) (int, *h264SPS, error) {
+	b := newBitReader(nal[1:])
+	s := &h264SPS{chromaFormat: 1}
+	s.profileIdc = b.u(8)
+	b.u(16) // constraint flags and level
+	id := b.ue()
+	switch s.profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		s.chromaFormat = b.ue()
+		if s.chromaFormat == 3 {
+			b.u(1)
+		}
+		if b.ue() != 0 || b.ue() != 0 { // bit depths
+			return 0, nil, errUnsupportedStream
+		}
+		b.u(1)
+		if b.flag() { // scaling matrices
+			return 0, nil, errUnsupportedStream
+		}
+	}
+	if s.chromaFormat != 1 {
+		return 0, nil, errUnsupportedStream
+	}
+	s.log2MaxFrameNum = b.ue() + 4
+	s.pocType = b.ue()
+	if s.pocType == 0 {
+		s.log2MaxPocLsb = b.ue() + 4
+	} else if s.pocType == 1 {
+		s.deltaPicOrderAlwaysZero = b.flag()
+		b.se()
+		b.se()
+		for n := b.ue(); n > 0 && !b.overrun(); n-- {
+			b.se()
+		}
+	}
+	b.ue() // max_num_ref_frames
+	b.u(1)
+	s.widthMbs = b.ue() + 1
+	s.heightMbs = b.ue() + 1
+	if !b.flag() { // frame_mbs_only_flag
+		return 0, nil, errUnsupportedStream
+	}
+	b.u(1) // direct_8x8_inference_flag
+	if b.flag() {
+		s.cropLeft, s.cropRight = b.ue()*2, b.ue()*2
+		s.cropTop, s.cropBottom = b.ue()*2, b.ue()*2
+	}
+	if b.overrun() || s.widthMbs > 512 || s.heightMbs > 512 {
+		return 0, nil, errCorruptStream
+	}
+	// doubled crops can wrap negative where int is 32 bits, which uint makes too large
+	width, height := uint(s.widthMbs*16), uint(s.heightMbs*16)
+	if uint(s.cropLeft) >= width || uint(s.cropRight) >= width || uint(s.cropTop) >= height || uint(s.cropBottom) >= height ||
+		s.cropLeft+s.cropRight >= s.widthMbs*16 || s.cropTop+s.cropBottom >= s.heightMbs*16 {
+		return 0, nil, errCorruptStream
+	}
+	return id, s, nil
+}
+
+type h264PPS struct {
+	sps                 int
+	bottomFieldPicOrder bool
+	initQP              int
+	chromaQPOffset      [2]int
+	deblockingControl   bool
+	redundantPicCnt     bool
+}
+
+func parsePPS(nal []byte) (int, *h264PPS, error) {
+	b := newBitReader(nal[1:])
+	p := &h264PPS{}
+	id := b.ue()
+	p.sps = b.ue()
+	if b.flag() { // CABAC
+		return 0, nil, errUnsupportedStream
+	}
+	p.bottomFieldPicOrder = b.flag()
+	if b.ue() != 0 { // slice groups
+		return 0, nil, errUnsupportedStream
+	}
+	b.ue()
+	b.ue()
+	b.u(3) // weighted prediction
+	p.initQP = 26 + b.se()
+	b.se()
+	p.chromaQPOffset[0] = b.se()
+	p.chromaQPOffset[1] = p.chromaQPOffset[0]
+	p.deblockingControl = b.flag()
+	b.u(1) // constrained_intra_pred_flag
+	p.redundantPicCnt = b.flag()
+	if b.moreData() {
+		if b.flag() || b.flag() { // 8x8 transform or scaling matrices
+			return 0, nil, errUnsupportedStream
+		}
+		p.chromaQPOffset[1] = b.se()
+	}
+	if b.overrun() || p.initQP < 0 || p.initQP > 51 {
+		return 0, nil, errCorruptStream
+	}
+	return id, p, nil
+}
+
+// h264MB is the state of a decoded macroblock that its neighbours depend on
+type h264MB struct {
+	slice  int // 1 based index of the slice, 0 if not decoded
+	qp     int
+	pcm    bool
+	i4x4   bool
+	modes  [16]int8     // intra 4x4 prediction modes by block index
+	coeffs [3][16]uint8 // total coefficients of luma, Cb, and Cr blocks
+}
+
+type h264Slice struct {
+	deblocking        int // disable_deblocking_filter_idc
+	alphaOff, betaOff int
+	chromaQPOffset    [2]int
+}
+
+// h264Decoder decodes an intra coded picture from its SPS, PPS, and slices
+type h264Decoder struct {
+	sps map[int]*h264SPS
+	pps map[int]*h264PPS
+
+	cur    *h264SPS
+	img    *image.YCbCr
+	mbs    []h264MB
+	slices []h264Slice
+}
+
+func newH264Decoder() *h264Decoder {
+	return &h264Decoder{sps: make(map[int]*h264SPS), pps: make(map[int]*h264PPS)}
+}
+
+// decode decodes the picture made of the given NAL units, which may start with its parameter sets
+func (d *h264Decoder) decode(nals [][]byte) (*image.YCbCr, error) {
+	d.cur, d.img, d.mbs, d.slices = nil, nil, nil, nil
+	for _, nal := range nals {
+		if len(nal) < 2 {
+			continue
+		}
+		var err error
+		switch nal[0] & 0x1f {
+		case nalSPS:
+			var id int
+			var s *h264SPS
+			if id, s, err = parseSPS(nal); err == nil {
+				d.sps[id] = s
+			}
+		case nalPPS:
+			var id int
+			var p *h264PPS
+			if id, p, err = parsePPS(nal); err == nil {
+				d.pps[id] = p
+			}
+		case nalSlice, nalIDRSlice:
+			err = d.decodeSlice(nal)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if d.img == nil {
+		return nil, errors.New("no picture in H.264 stream")
+	}
+	for i := range d.mbs {
+		if d.mbs[i].slice == 0 {
+			return nil, errors.New("incomplete H.264 picture")
+		}
+	}
+
+	d.deblock()
+	s := d.cur
+	crop := image.Rect(s.cropLeft, s.cropTop, s.widthMbs*16-s.cropRight, s.heightMbs*16-s.cropBottom)
+	return d.img.SubImage(crop).(*image.YCbCr), nil
+}
+
+func (d *h264Decoder) decodeSlice(nal []byte) error {
+	refIdc := nal[0] >> 5 & 3
+	idr := nal[0]&0x1f == nalIDRSlice
+	b := newBitReader(nal[1:])
+
+	firstMb := b.ue()
+	if b.overrun() || firstMb < 0 {
+		return errCorruptStream
+	}
+	if b.ue()%5 != 2 {
+		return errors.New("not an intra coded H.264 slice")
+	}
+	pps := d.pps[b.ue()]
+	if pps == nil || d.sps[pps.sps] == nil {
+		return errors.New("H.264 slice without parameter sets")
+	}
+	sps := d.sps[pps.sps]
+	if d.img == nil {
+		d.cur = sps
+		d.img = image.NewYCbCr(image.Rect(0, 0, sps.widthMbs*16, sps.heightMbs*16), image.YCbCrSubsampleRatio420)
+		d.mbs = make([]h264MB, sps.widthMbs*sps.heightMbs)
+	} else if sps != d.cur {
+		return errCorruptStream
+	}
+
+	b.u(sps.log2MaxFrameNum) // frame_num
+	if idr {
+		b.ue() // idr_pic_id
+	}
+	if sps.pocType == 0 {
+		b.u(sps.log2MaxPocLsb)
+		if pps.bottomFieldPicOrder {
+			b.se()
+		}
+	} else if sps.pocType == 1 && !sps.deltaPicOrderAlwaysZero {
+		b.se()
+		if pps.bottomFieldPicOrder {
+			b.se()
+		}
+	}
+	if pps.redundantPicCnt {
+		if b.ue() != 0 {
+			return errors.New("redundant H.264 slice")
+		}
+	}
+	if refIdc != 0 { // dec_ref_pic_marking
+		if idr {
+			b.u(2)
+		} else if b.flag() {
+			for op := b.ue(); op != 0 && !b.overrun(); op = b.ue() {
+				if op == 1 || op == 3 {
+					b.ue()
+				}
+				if op == 2 || op == 3 || op == 4 || op == 6 {
+					b.ue()
+				}
+			}
+		}
+	}
+	qp := pps.initQP + b.se()
+	slice := h264Slice{chromaQPOffset: pps.chromaQPOffset}
+	if pps.deblockingControl {
+		slice.deblocking = b.ue()
+		if slice.deblocking != 1 {
+			slice.alphaOff = b.se() * 2
+			slice.betaOff = b.se() * 2
+		}
+	}
+	if b.overrun() || qp < 0 || qp > 51 || slice.deblocking > 2 {
+		return errCorruptStream
+	}
+	d.slices = append(d.slices, slice)
+
+	for addr := firstMb; ; addr++ {
+		if addr >= len(d.mbs) || d.mbs[addr].slice != 0 {
+			return errCorruptStream
+		}
+		if err := d.decodeMB(b, addr, len(d.slices), &qp); err != nil {
+			return err
+		}
+		if b.overrun() {
+			return errCorruptStream
+		}
+		if !b.moreData() {
+			return nil
+		}
+	}
+}
+
+// intraCBP maps coded_block_pattern codes of intra macroblocks to the pattern
+var intraCBP = [48]int{
+	47, 31, 15, 0, 23, 27, 29, 30, 7, 11, 13, 14, 39, 43, 45, 46,
+	16, 3, 5, 10, 12, 19, 21, 26, 28, 35, 37, 42, 44, 1, 2, 4,
+	8, 17, 18, 20, 24, 6, 9, 22, 25, 32, 33, 34, 36, 40, 38, 41,
+}
+
+// position of 4x4 luma blocks within a macroblock by index, in blocks
+var blkX = [16]int{0, 1, 0, 1, 2, 3, 2, 3, 0, 1, 0, 1, 2, 3, 2, 3}
+var blkY = [16]int{0, 0, 1, 1, 0, 0, 1, 1, 2, 2, 3, 3, 2, 2, 3, 3}
+var blkAt = [4][4]int{{0, 1, 4, 5}, {2, 3, 6, 7}, {8, 9, 12, 13}, {10, 11, 14, 15}}
+
+var zigzag4x4 = [16]int{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+
+// neighbour returns the macroblock containing block (x, y) of the blocks of size n
+// around macroblock addr, where x or y may be -1, and the block's position within it
+func (d *h264Decoder) neighbour(addr int, x int, y int, n int) (int, int, int, bool) {
+	w := d.cur.widthMbs
+	nb := addr
+	if x < 0 {
+		if addr%w == 0 {
+			return 0, 0, 0, false
+		}
+		nb--
+		x += n
+	} else if x >= n {
+		if addr%w == w-1 {
+			return 0, 0, 0, false
+		}
+		nb++
+		x -= n
+	}
+	if y < 0 {
+		nb -= w
+		y += n
+	}
+	if nb < 0 || (nb != addr && d.mbs[nb].slice != d.mbs[addr].slice) {
+		return 0, 0, 0, false
+	}
+	return nb, x, y, true
+}
+
+// totalCoeff returns the coefficients of the neighbouring block (x, y) of plane c, if available
+func (d *h264Decoder) totalCoeff(addr int, c int, x int, y int) (int, bool) {
+	n := 4
+	if c > 0 {
+		n = 2
+	}
+	nb, x, y, ok := d.neighbour(addr, x, y, n)
+	if !ok {
+		return 0, false
+	}
+	if d.mbs[nb].pcm {
+		return 16, true
+	}
+	if c == 0 {
+		return int(d.mbs[nb].coeffs[0][blkAt[y][x]]), true
+	}
+	return int(d.mbs[nb].coeffs[c][y*2+x]), true
+}
+
+// predictedNC returns nC used to select the coeff_token table of block (x, y) of plane c
+func (d *h264Decoder) predictedNC(addr int, c int, x int, y int) int {
+	nA, okA := d.totalCoeff(addr, c, x-1, y)
+	nB, okB := d.totalCoeff(addr, c, x, y-1)
+	switch {
+	case okA && okB:
+		return (nA + nB + 1) >> 1
+	case okA:
+		return nA
+	case okB:
+		return nB
+	}
+	return 0
+}
+
+func (d *h264Decoder) decodeMB(b *bitReader, addr int, slice int, qp *int) error {
+	mb := &d.mbs[addr]
+	mb.slice = slice
+	mbType := b.ue()
+	if mbType > 25 {
+		return errCorruptStream
+	}
+
+	x0, y0 := addr%d.cur.widthMbs*16, addr/d.cur.widthMbs*16
+	if mbType == 25 { // I_PCM
+		mb.pcm = true
+		b.pos = (b.pos + 7) &^ 7
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 16; x++ {
+				d.img.Y[(y0+y)*d.img.YStride+x0+x] = uint8(b.u(8))
+			}
+		}
+		for _, plane := range [][]byte{d.img.Cb, d.img.Cr} {
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					plane[(y0/2+y)*d.img.CStride+x0/2+x] = uint8(b.u(8))
+				}
+			}
+		}
+		mb.qp = *qp
+		return nil
+	}
+
+	var rem [16]int
+	if mbType == 0 {
+		mb.i4x4 = true
+		for i := range rem {
+			rem[i] = -1
+			if !b.flag() {
+				rem[i] = b.u(3)
+			}
+		}
+	}
+	chromaMode := b.ue()
+	if chromaMode > 3 {
+		return errCorruptStream
+	}
+	var cbpLuma, cbpChroma int
+	if mbType == 0 {
+		code := b.ue()
+		if code > 47 {
+			return errCorruptStream
+		}
+		cbpLuma, cbpChroma = intraCBP[code]&15, intraCBP[code]>>4
+	} else {
+		cbpChroma = (mbType - 1) / 4 % 3
+		if mbType >= 13 {
+			cbpLuma = 15
+		}
+	}
+	if cbpLuma > 0 || cbpChroma > 0 || mbType != 0 {
+		delta := b.se()
+		if delta < -26 || delta > 25 {
+			return errCorruptStream
+		}
+		*qp = (*qp + delta + 52) % 52
+	}
+	mb.qp = *qp
+
+	// residuals
+	var luma [16][16]int32 // by block, in raster order
+	var lumaDC [16]int32
+	var list [16]int32
+	if mbType != 0 {
+		n, err := residualBlock(b, d.predictedNC(addr, 0, 0, 0), list[:16])
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			for i, v := range list {
+				lumaDC[zigzag4x4[i]] = v
+			}
+		}
+	}
+	for blk := 0; blk < 16; blk++ {
+		if cbpLuma&(1<<uint(blk/4)) == 0 {
+			continue
+		}
+		max, start := 16, 0
+		if mbType != 0 {
+			max, start = 15, 1
+		}
+		n, err := residualBlock(b, d.predictedNC(addr, 0, blkX[blk], blkY[blk]), list[:max])
+		if err != nil {
+			return err
+		}
+		mb.coeffs[0][blk] = uint8(n)
+		for i := 0; i < max; i++ {
+			luma[blk][zigzag4x4[i+start]] = list[i]
+		}
+	}
+
+	var chroma [2][4][16]int32
+	var chromaDC [2][4]int32
+	if cbpChroma != 0 {
+		for c := 0; c < 2; c++ {
+			if _, err := residualBlock(b, -1, chromaDC[c][:]); err != nil {
+				return err
+			}
+		}
+	}
+	if cbpChroma == 2 {
+		for c := 0; c < 2; c++ {
+			for blk := 0; blk < 4; blk++ {
+				n, err := residualBlock(b, d.predictedNC(addr, c+1, blk%2, blk/2), list[:15])
+				if err != nil {
+					return err
+				}
+				mb.coeffs[c+1][blk] = uint8(n)
+				for i := 0; i < 15; i++ {
+					chroma[c][blk][zigzag4x4[i+1]] = list[i]
+				}
+			}
+		}
+	}
+	if b.overrun() {
+		return errCorruptStream
+	}
+
+	// reconstruction
+	if mbType == 0 {
+		for blk := 0; blk < 16; blk++ {
+			mode := d.predictedMode(addr, blk)
+			if rem[blk] >= 0 {
+				if rem[blk] < mode {
+					mode = rem[blk]
+				} else {
+					mode = rem[blk] + 1
+				}
+			}
+			mb.modes[blk] = int8(mode)
+			x, y := x0+blkX[blk]*4, y0+blkY[blk]*4
+			if err := d.predict4x4(addr, blk, mode, x, y); err != nil {
+				return err
+			}
+			dequant4x4(&luma[blk], *qp, false)
+			addResidual(d.img.Y, d.img.YStride, x, y, &luma[blk])
+		}
+	} else {
+		if err := d.predict16x16(addr, (mbType-1)%4, x0, y0); err != nil {
+			return err
+		}
+		dc := lumaDCTransform(lumaDC, *qp)
+		for blk := 0; blk < 16; blk++ {
+			dequant4x4(&luma[blk], *qp, true)
+			luma[blk][0] = dc[blkY[blk]*4+blkX[blk]]
+			addResidual(d.img.Y, d.img.YStride, x0+blkX[blk]*4, y0+blkY[blk]*4, &luma[blk])
+		}
+	}
+
+	for c, plane := range [][]byte{d.img.Cb, d.img.Cr} {
+		if err := d.predictChroma(addr, chromaMode, plane, x0/2, y0/2); err != nil {
+			return err
+		}
+		cqp := chromaQP(*qp + d.slices[slice-1].chromaQPOffset[c])
+		dc := chromaDCTransform(chromaDC[c], cqp)
+		for blk := 0; blk < 4; blk++ {
+			dequant4x4(&chroma[c][blk], cqp, true)
+			chroma[c][blk][0] = dc[blk]
+			addResidual(plane, d.img.CStride, x0/2+blk%2*4, y0/2+blk/2*4, &chroma[c][blk])
+		}
+	}
+	return nil
+}
+
+// predictedMode returns the predicted intra 4x4 prediction mode of a block
+func (d *h264Decoder) predictedMode(addr int, blk int) int {
+	modeOf := func(x, y int) (int, bool) {
+		nb, x, y, ok := d.neighbour(addr, x, y, 4)
+		if !ok {
+			return 0, false
+		}
+		if !d.mbs[nb].i4x4 {
+			return 2, true
+		}
+		return int(d.mbs[nb].modes[blkAt[y][x]]), true
+	}
+	a, okA := modeOf(blkX[blk]-1, blkY[blk])
+	b, okB := modeOf(blkX[blk], blkY[blk]-1)
+	if !okA || !okB {
+		return 2
+	}
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// coeff_token codes by nC range, indexed by TotalCoeff*4 + TrailingOnes
+var coeffTokenLen = [5][4 * 17]uint8{
+	{
+		1, 0, 0, 0, 6, 2, 0, 0, 8, 6, 3, 0, 9, 8, 7, 5, 10, 9, 8, 6,
+		11, 10, 9, 7, 13, 11, 10, 8, 13, 13, 11, 9, 13, 13, 13, 10,
+		14, 14, 13, 11, 14, 14, 14, 13, 15, 15, 14, 14, 15, 15, 15, 14,
+		16, 15, 15, 15, 16, 16, 16, 15, 16, 16, 16, 16, 16, 16, 16, 16,
+	},
+	{
+		2, 0, 0, 0, 6, 2, 0, 0, 6, 5, 3, 0, 7, 6, 6, 4, 8, 6, 6, 4,
+		8, 7, 7, 5, 9, 8, 8, 6, 11, 9, 9, 6, 11, 11, 11, 7,
+		12, 11, 11, 9, 12, 12, 12, 11, 12, 12, 12, 11, 13, 13, 13, 12,
+		13, 13, 13, 13, 13, 14, 13, 13, 14, 14, 14, 13, 14, 14, 14, 14,
+	},
+	{
+		4, 0, 0, 0, 6, 4, 0, 0, 6, 5, 4, 0, 6, 5, 5, 4, 7, 5, 5, 4,
+		7, 5, 5, 4, 7, 6, 6, 4, 7, 6, 6, 4, 8, 7, 7, 5,
+		8, 8, 7, 6, 9, 8, 8, 7, 9, 9, 8, 8, 9, 9, 9, 8,
+		10, 9, 9, 9, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10,
+	},
+	{
+		6, 0, 0, 0, 6, 6, 0, 0, 6, 6, 6, 0, 6, 6, 6, 6, 6, 6, 6, 6,
+		6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+		6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+		6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+	},
+	{ // chroma DC
+		2, 0, 0, 0, 6, 1, 0, 0, 6, 6, 3, 0, 6, 7, 7, 6, 6, 8, 8, 7,
+	},
+}
+
+var coeffTokenCode = [5][4 * 17]uint8{
+	{
+		1, 0, 0, 0, 5, 1, 0, 0, 7, 4, 1, 0, 7, 6, 5, 3, 7, 6, 5, 3,
+		7, 6, 5, 4, 15, 6, 5, 4, 11, 14, 5, 4, 8, 10, 13, 4,
+		15, 14, 9, 4, 11, 10, 13, 12, 15, 14, 9, 12, 11, 10, 13, 8,
+		15, 1, 9, 12, 11, 14, 13, 8, 7, 10, 9, 12, 4, 6, 5, 8,
+	},
+	{
+		3, 0, 0, 0, 11, 2, 0, 0, 7, 7, 3, 0, 7, 10, 9, 5, 7, 6, 5, 4,
+		4, 6, 5, 6, 7, 6, 5, 8, 15, 6, 5, 4, 11, 14, 13, 4,
+		15, 10, 9, 4, 11, 14, 13, 12, 8, 10, 9, 8, 15, 14, 13, 12,
+		11, 10, 9, 12, 7, 11, 6, 8, 9, 8, 10, 1, 7, 6, 5, 4,
+	},
+	{
+		15, 0, 0, 0, 15, 14, 0, 0, 11, 15, 13, 0, 8, 12, 14, 12, 15, 10, 11, 11,
+		11, 8, 9, 10, 9, 14, 13, 9, 8, 10, 9, 8, 15, 14, 13, 13,
+		11, 14, 10, 12, 15, 10, 13, 12, 11, 14, 9, 12, 8, 10, 13, 8,
+		13, 7, 9, 12, 9, 12, 11, 10, 5, 8, 7, 6, 1, 4, 3, 2,
+	},
+	{
+		3, 0, 0, 0, 0, 1, 0, 0, 4, 5, 6, 0, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+		32, 33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47,
+		48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63,
+	},
+	{
+		1, 0, 0, 0, 7, 1, 0, 0, 4, 6, 1, 0, 3, 3, 2, 5, 2, 3, 2, 0,
+	},
+}
+
+// total_zeros codes by TotalCoeff-1, indexed by total_zeros
+var totalZerosLen = [15][16]uint8{
+	{1, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 9},
+	{3, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 6, 6, 6, 6},
+	{4, 3, 3, 3, 4, 4, 3, 3, 4, 5, 5, 6, 5, 6},
+	{5, 3, 4, 4, 3, 3, 3, 4, 3, 4, 5, 5, 5},
+	{4, 4, 4, 3, 3, 3, 3, 3, 4, 5, 4, 5},
+	{6, 5, 3, 3, 3, 3, 3, 3, 4, 3, 6},
+	{6, 5, 3, 3, 3, 2, 3, 4, 3, 6},
+	{6, 4, 5, 3, 2, 2, 3, 3, 6},
+	{6, 6, 4, 2, 2, 3, 2, 5},
+	{5, 5, 3, 2, 2, 2, 4},
+	{4, 4, 3, 3, 1, 3},
+	{4, 4, 2, 1, 3},
+	{3, 3, 1, 2},
+	{2, 2, 1},
+	{1, 1},
+}
+
+var totalZerosCode = [15][16]uint8{
+	{1, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 1},
+	{7, 6, 5, 4, 3, 5, 4, 3, 2, 3, 2, 3, 2, 1, 0},
+	{5, 7, 6, 5, 4, 3, 4, 3, 2, 3, 2, 1, 1, 0},
+	{3, 7, 5, 4, 6, 5, 4, 3, 3, 2, 2, 1, 0},
+	{5, 4, 3, 7, 6, 5, 4, 3, 2, 1, 1, 0},
+	{1, 1, 7, 6, 5, 4, 3, 2, 1, 1, 0},
+	{1, 1, 5, 4, 3, 3, 2, 1, 1, 0},
+	{1, 1, 1, 3, 3, 2, 2, 1, 0},
+	{1, 0, 1, 3, 2, 1, 1, 1},
+	{1, 0, 1, 3, 2, 1, 1},
+	{0, 1, 1, 2, 1, 3},
+	{0, 1, 1, 1, 1},
+	{0, 1, 1, 1},
+	{0, 1, 1},
+	{0, 1},
+}
+
+var chromaDCTotalZerosLen = [3][4]uint8{{1, 2, 3, 3}, {1, 2, 2}, {1, 1}}
+var chromaDCTotalZerosCode = [3][4]uint8{{1, 1, 1, 0}, {1, 1, 0}, {1, 0}}
+
+// run_before codes by min(zerosLeft, 7)-1
+var runBeforeLen = [7][15]uint8{
+	{1, 1},
+	{1, 2, 2},
+	{2, 2, 2, 2},
+	{2, 2, 2, 3, 3},
+	{2, 2, 3, 3, 3, 3},
+	{2, 3, 3, 3, 3, 3, 3},
+	{3, 3, 3, 3, 3, 3, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+}
+
+var runBeforeCode = [7][15]uint8{
+	{1, 0},
+	{1, 1, 0},
+	{3, 2, 1, 0},
+	{3, 2, 1, 1, 0},
+	{3, 2, 3, 2, 1, 0},
+	{3, 0, 1, 3, 2, 5, 4},
+	{7, 6, 5, 4, 3, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+}
+
+// readVLC reads a code from a table of code lengths and values, returning its index
+func readVLC(b *bitReader, lens []uint8, codes []uint8) (int, bool) {
+	bits := b.peek(16)
+	best := -1
+	for i, l := range lens {
+		if l != 0 && bits>>uint(16-l) == int(codes[i]) && (best < 0 || l < lens[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	b.pos += int(lens[best])
+	return best, true
+}
+
+// residualBlock reads a CAVLC coded block of len(coeffs) coefficients in scan order,
+// returning the number of non-zero coefficients. nC is -1 for chroma DC.
+func residualBlock(b *bitReader, nC int, coeffs []int32) (int, error) {
+	for i := range coeffs {
+		coeffs[i] = 0
+	}
+
+	table := 0
+	switch {
+	case nC < 0:
+		table = 4
+	case nC >= 8:
+		table = 3
+	case nC >= 4:
+		table = 2
+	case nC >= 2:
+		table = 1
+	}
+	token, ok := readVLC(b, coeffTokenLen[table][:], coeffTokenCode[table][:])
+	total, trailingOnes := token/4, token%4
+	if !ok || total > len(coeffs) {
+		return 0, errCorruptStream
+	}
+	if total == 0 {
+		return 0, nil
+	}
+
+	var levels [16]int
+	suffixLength := 0
+	if total > 10 && trailingOnes < 3 {
+		suffixLength = 1
+	}
+	for i := 0; i < total; i++ {
+		if i < trailingOnes {
+			levels[i] = 1 - 2*b.u(1)
+			continue
+		}
+		prefix := 0
+		for b.u(1) == 0 {
+			if prefix++; prefix > 32 {
+				return 0, errCorruptStream
+			}
+		}
+		code := prefix
+		if prefix > 15 {
+			code = 15
+		}
+		code <<= uint(suffixLength)
+		suffixSize := suffixLength
+		if prefix == 14 && suffixLength == 0 {
+			suffixSize = 4
+		} else if prefix >= 15 {
+			suffixSize = prefix - 3
+		}
+		if suffixSize > 0 {
+			code += b.u(suffixSize)
+		}
+		if prefix >= 15 && suffixLength == 0 {
+			code += 15
+		}
+		if prefix >= 16 {
+			code += 1<<uint(prefix-3) - 4096
+		}
+		if i == trailingOnes && trailingOnes < 3 {
+			code += 2
+		}
+		if code%2 == 0 {
+			levels[i] = (code + 2) >> 1
+		} else {
+			levels[i] = (-code - 1) >> 1
+		}
+		if suffixLength == 0 {
+			suffixLength = 1
+		}
+		if abs(levels[i]) > 3<<uint(suffixLength-1) && suffixLength < 6 {
+			suffixLength++
+		}
+	}
+
+	zeros := 0
+	if total < len(coeffs) {
+		var v int
+		if len(coeffs) == 4 {
+			v, ok = readVLC(b, chromaDCTotalZerosLen[total-1][:], chromaDCTotalZerosCode[total-1][:])
+		} else {
+			v, ok = readVLC(b, totalZerosLen[total-1][:], totalZerosCode[total-1][:])
+		}
+		if !ok {
+			return 0, errCorruptStream
+		}
+		zeros = v
+	}
+	if zeros+total > len(coeffs) {
+		return 0, errCorruptStream
+	}
+
+	pos := zeros + total - 1
+	for i := 0; i < total; i++ {
+		coeffs[pos] = int32(levels[i])
+		run := 0
+		if i < total-1 && zeros > 0 {
+			t := zeros
+			if t > 7 {
+				t = 7
+			}
+			run, ok = readVLC(b, runBeforeLen[t-1][:], runBeforeCode[t-1][:])
+			if !ok || run > zeros {
+				return 0, errCorruptStream
+			}
+			zeros -= run
+		}
+		pos -= run + 1
+	}
+	return total, nil
+}
+
+func clip1(v int32) uint8 {
+	if v < 0 {
+		return 0
+	} else if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+var dequantScale = [6][3]int32{{10, 16, 13}, {11, 18, 14}, {13, 20, 16}, {14, 23, 18}, {16, 25, 20}, {18, 29, 23}}
+
+// dequantScaleAt returns the scale of coefficient i of a 4x4 block at qp
+func dequantScaleAt(qp int, i int) int32 {
+	x, y := i%4, i/4
+	switch {
+	case x%2 == 0 && y%2 == 0:
+		return dequantScale[qp%6][0]
+	case x%2 == 1 && y%2 == 1:
+		return dequantScale[qp%6][1]
+	}
+	return dequantScale[qp%6][2]
+}
+
+// dequant4x4 scales the coefficients of a block, except its DC if it's coded separately
+func dequant4x4(c *[16]int32, qp int, skipDC bool) {
+	for i := range c {
+		if i == 0 && skipDC {
+			continue
+		}
+		c[i] = c[i] * dequantScaleAt(qp, i) << uint(qp/6)
+	}
+}
+
+// lumaDCTransform inverse transforms and scales the DC coefficients of an intra 16x16 macroblock
+func lumaDCTransform(c [16]int32, qp int) [16]int32 {
+	var t, f [16]int32
+	for i := 0; i < 4; i++ {
+		a, b, cc, d := c[i*4], c[i*4+1], c[i*4+2], c[i*4+3]
+		t[i*4], t[i*4+1], t[i*4+2], t[i*4+3] = a+b+cc+d, a+b-cc-d, a-b-cc+d, a-b+cc-d
+	}
+	for i := 0; i < 4; i++ {
+		a, b, cc, d := t[i], t[4+i], t[8+i], t[12+i]
+		f[i], f[4+i], f[8+i], f[12+i] = a+b+cc+d, a+b-cc-d, a-b-cc+d, a-b+cc-d
+	}
+	scale := 16 * dequantScale[qp%6][0]
+	for i := range f {
+		if qp >= 36 {
+			f[i] = f[i] * scale << uint(qp/6-6)
+		} else {
+			f[i] = (f[i]*scale + 1<<uint(5-qp/6)) >> uint(6-qp/6)
+		}
+	}
+	return f
+}
+
+// chromaDCTransform inverse transforms and scales the DC coefficients of a chroma block
+func chromaDCTransform(c [4]int32, qp int) [4]int32 {
+	f := [4]int32{
+		c[0] + c[1] + c[2] + c[3],
+		c[0] - c[1] + c[2] - c[3],
+		c[0] + c[1] - c[2] - c[3],
+		c[0] - c[1] - c[2] + c[3],
+	}
+	scale := 16 * dequantScale[qp%6][0]
+	for i := range f {
+		f[i] = (f[i] * scale << uint(qp/6)) >> 5
+	}
+	return f
+}
+
+var chromaQPTable = [22]int{29, 30, 31, 32, 32, 33, 34, 34, 35, 35, 36, 36, 37, 37, 37, 38, 38, 38, 39, 39, 39, 39}
+
+// chromaQP returns the chroma quantizer for a luma quantizer plus the chroma offset
+func chromaQP(qp int) int {
+	if qp < 0 {
+		qp = 0
+	} else if qp > 51 {
+		qp = 51
+	}
+	if qp < 30 {
+		return qp
+	}
+	return chromaQPTable[qp-30]
+}
+
+// addResidual inverse transforms a block and adds it to the prediction at (x, y)
+func addResidual(plane []byte, stride int, x int, y int, c *[16]int32) {
+	var t [16]int32
+	for i := 0; i < 4; i++ {
+		d0, d1, d2, d3 := c[i*4], c[i*4+1], c[i*4+2], c[i*4+3]
+		e0, e1, e2, e3 := d0+d2, d0-d2, d1>>1-d3, d1+d3>>1
+		t[i*4], t[i*4+1], t[i*4+2], t[i*4+3] = e0+e3, e1+e2, e1-e2, e0-e3
+	}
+	for i := 0; i < 4; i++ {
+		d0, d1, d2, d3 := t[i], t[4+i], t[8+i], t[12+i]
+		e0, e1, e2, e3 := d0+d2, d0-d2, d1>>1-d3, d1+d3>>1
+		r := [4]int32{e0 + e3, e1 + e2, e1 - e2, e0 - e3}
+		for j, v := range r {
+			p := (y+j)*stride + x + i
+			plane[p] = clip1(int32(plane[p]) + (v+32)>>6)
+		}
+	}
+}
+
+// edges holds the samples around a block used for intra prediction, with the top left
+// sample at index 0 of both top and left
+type edges struct {
+	top, left       [17]int32
+	hasTop, hasLeft bool
+	hasTopLeft      bool
+	hasTopRight     bool
+}
+
+// loadEdges reads the samples above and left of the n by n block at (x, y), with m samples
+// above to the right
+func loadEdges(plane []byte, stride int, x int, y int, n int, m int, e *edges) {
+	if e.hasTop {
+		for i := 0; i < n; i++ {
+			e.top[i+1] = int32(plane[(y-1)*stride+x+i])
+		}
+		for i := n; i < n+m; i++ {
+			if e.hasTopRight {
+				e.top[i+1] = int32(plane[(y-1)*stride+x+i])
+			} else {
+				e.top[i+1] = e.top[n]
+			}
+		}
+	}
+	if e.hasLeft {
+		for i := 0; i < n; i++ {
+			e.left[i+1] = int32(plane[(y+i)*stride+x-1])
+		}
+	}
+	if e.hasTopLeft {
+		e.top[0] = int32(plane[(y-1)*stride+x-1])
+		e.left[0] = e.top[0]
+	}
+}
+
+var errPrediction = errors.New("H.264 intra prediction uses unavailable samples")
+
+func (d *h264Decoder) predict4x4(addr int, blk int, mode int, x int, y int) error {
+	bx, by := blkX[blk], blkY[blk]
+	e := edges{}
+	_, _, _, e.hasLeft = d.neighbour(addr, bx-1, by, 4)
+	_, _, _, e.hasTop = d.neighbour(addr, bx, by-1, 4)
+	_, _, _, e.hasTopLeft = d.neighbour(addr, bx-1, by-1, 4)
+	if by == 0 {
+		_, _, _, e.hasTopRight = d.neighbour(addr, bx+1, -1, 4)
+	} else {
+		e.hasTopRight = bx < 3 && blkAt[by-1][bx+1] < blk
+	}
+	img := d.img
+	loadEdges(img.Y, img.YStride, x, y, 4, 4, &e)
+	// p(x, -1) and p(-1, y), where -1 is the top left sample
+	top := func(i int) int32 { return e.top[i+1] }
+	left := func(i int) int32 { return e.left[i+1] }
+
+	var pred [16]int32
+	switch mode {
+	case 0: // vertical
+		if !e.hasTop {
+			return errPrediction
+		}
+		for i := range pred {
+			pred[i] = top(i % 4)
+		}
+	case 1: // horizontal
+		if !e.hasLeft {
+			return errPrediction
+		}
+		for i := range pred {
+			pred[i] = left(i / 4)
+		}
+	case 2: // DC
+		sum, n := int32(0), 0
+		if e.hasTop {
+			for i := 0; i < 4; i++ {
+				sum += top(i)
+			}
+			n++
+		}
+		if e.hasLeft {
+			for i := 0; i < 4; i++ {
+				sum += left(i)
+			}
+			n++
+		}
+		dc := int32(128)
+		if n == 2 {
+			dc = (sum + 4) >> 3
+		} else if n == 1 {
+			dc = (sum + 2) >> 2
+		}
+		for i := range pred {
+			pred[i] = dc
+		}
+	case 3: // diagonal down left
+		if !e.hasTop {
+			return errPrediction
+		}
+		for i := range pred {
+			px, py := i%4, i/4
+			if px == 3 && py == 3 {
+				pred[i] = (top(6) + 3*top(7) + 2) >> 2
+			} else {
+				pred[i] = (top(px+py) + 2*top(px+py+1) + top(px+py+2) + 2) >> 2
+			}
+		}
+	case 4, 5, 6: // diagonal down right, vertical right, horizontal down
+		if !e.hasTop || !e.hasLeft || !e.hasTopLeft {
+			return errPrediction
+		}
+		// p returns p(x, -1) for y == -1, else p(-1, y)
+		p := func(px, py int) int32 {
+			if py == -1 {
+				return top(px)
+			}
+			return left(py)
+		}
+		for i := range pred {
+			px, py := i%4, i/4
+			switch mode {
+			case 4:
+				if px > py {
+					pred[i] = (p(px-py-2, -1) + 2*p(px-py-1, -1) + p(px-py, -1) + 2) >> 2
+				} else if px < py {
+					pred[i] = (p(-1, py-px-2) + 2*p(-1, py-px-1) + p(-1, py-px) + 2) >> 2
+				} else {
+					pred[i] = (p(0, -1) + 2*p(-1, -1) + p(-1, 0) + 2) >> 2
+				}
+			case 5:
+				z := 2*px - py
+				switch {
+				case z >= 0 && z%2 == 0:
+					pred[i] = (p(px-py>>1-1, -1) + p(px-py>>1, -1) + 1) >> 1
+				case z > 0:
+					pred[i] = (p(px-py>>1-2, -1) + 2*p(px-py>>1-1, -1) + p(px-py>>1, -1) + 2) >> 2
+				case z == -1:
+					pred[i] = (p(-1, 0) + 2*p(-1, -1) + p(0, -1) + 2) >> 2
+				default:
+					pred[i] = (p(-1, py-1) + 2*p(-1, py-2) + p(-1, py-3) + 2) >> 2
+				}
+			case 6:
+				z := 2*py - px
+				switch {
+				case z >= 0 && z%2 == 0:
+					pred[i] = (p(-1, py-px>>1-1) + p(-1, py-px>>1) + 1) >> 1
+				case z > 0:
+					pred[i] = (p(-1, py-px>>1-2) + 2*p(-1, py-px>>1-1) + p(-1, py-px>>1) + 2) >> 2
+				case z == -1:
+					pred[i] = (p(-1, 0) + 2*p(-1, -1) + p(0, -1) + 2) >> 2
+				default:
+					pred[i] = (p(px-1, -1) + 2*p(px-2, -1) + p(px-3, -1) + 2) >> 2
+				}
+			}
+		}
+	case 7: // vertical left
+		if !e.hasTop {
+			return errPrediction
+		}
+		for i := range pred {
+			px, py := i%4, i/4
+			if py%2 == 0 {
+				pred[i] = (top(px+py>>1) + top(px+py>>1+1) + 1) >> 1
+			} else {
+				pred[i] = (top(px+py>>1) + 2*top(px+py>>1+1) + top(px+py>>1+2) + 2) >> 2
+			}
+		}
+	case 8: // horizontal up
+		if !e.hasLeft {
+			return errPrediction
+		}
+		for i := range pred {
+			px, py := i%4, i/4
+			z := px + 2*py
+			switch {
+			case z > 5:
+				pred[i] = left(3)
+			case z == 5:
+				pred[i] = (left(2) + 3*left(3) + 2) >> 2
+			case z%2 == 0:
+				pred[i] = (left(py+px>>1) + left(py+px>>1+1) + 1) >> 1
+			default:
+				pred[i] = (left(py+px>>1) + 2*left(py+px>>1+1) + left(py+px>>1+2) + 2) >> 2
+			}
+		}
+	}
+
+	for i, v := range pred {
+		img.Y[(y+i/4)*img.YStride+x+i%4] = uint8(v)
+	}
+	return nil
+}
+
+// predictPlane fills an n by n block with intra 16x16 or chroma prediction
+func predictPlane(plane []byte, stride int, x int, y int, n int, mode int, e *edges, chroma bool) error {
+	top := func(i int) int32 { return e.top[i+1] }
+	left := func(i int) int32 { return e.left[i+1] }
+	set := func(px, py int, v int32) { plane[(y+py)*stride+x+px] = clip1(v) }
+
+	switch mode {
+	case 0: // vertical
+		if !e.hasTop {
+			return errPrediction
+		}
+		for py := 0; py < n; py++ {
+			for px := 0; px < n; px++ {
+				set(px, py, top(px))
+			}
+		}
+	case 1: // horizontal
+		if !e.hasLeft {
+			return errPrediction
+		}
+		for py := 0; py < n; py++ {
+			for px := 0; px < n; px++ {
+				set(px, py, left(py))
+			}
+		}
+	case 2: // DC
+		if chroma {
+			predictChromaDC(e, set)
+			return nil
+		}
+		sum, count := int32(0), 0
+		if e.hasTop {
+			for i := 0; i < n; i++ {
+				sum += top(i)
+			}
+			count++
+		}
+		if e.hasLeft {
+			for i := 0; i < n; i++ {
+				sum += left(i)
+			}
+			count++
+		}
+		dc := int32(128)
+		if count == 2 {
+			dc = (sum + 16) >> 5
+		} else if count == 1 {
+			dc = (sum + 8) >> 4
+		}
+		for py := 0; py < n; py++ {
+			for px := 0; px < n; px++ {
+				set(px, py, dc)
+			}
+		}
+	case 3: // plane
+		if !e.hasTop || !e.hasLeft || !e.hasTopLeft {
+			return errPrediction
+		}
+		half := n / 2
+		h, v := int32(0), int32(0)
+		for i := 0; i < half; i++ {
+			h += int32(i+1) * (top(half+i) - top(half-2-i))
+			v += int32(i+1) * (left(half+i) - left(half-2-i))
+		}
+		a := 16 * (left(n-1) + top(n-1))
+		var b, c int32
+		if chroma {
+			b, c = (34*h+32)>>6, (34*v+32)>>6
+		} else {
+			b, c = (5*h+32)>>6, (5*v+32)>>6
+		}
+		for py := 0; py < n; py++ {
+			for px := 0; px < n; px++ {
+				set(px, py, (a+b*int32(px-half+1)+c*int32(py-half+1)+16)>>5)
+			}
+		}
+	}
+	return nil
+}
+
+// predictChromaDC predicts each 4x4 block of an 8x8 chroma block from its nearest edges
+func predictChromaDC(e *edges, set func(px, py int, v int32)) {
+	for blk := 0; blk < 4; blk++ {
+		xO, yO := blk%2*4, blk/2*4
+		sumTop, sumLeft := int32(0), int32(0)
+		for i := 0; i < 4; i++ {
+			sumTop += e.top[xO+i+1]
+			sumLeft += e.left[yO+i+1]
+		}
+		useTop, useLeft := e.hasTop, e.hasLeft
+		if blk == 1 && useTop {
+			useLeft = false // the top right block prefers the samples above it
+		} else if blk == 2 && useLeft {
+			useTop = false // the bottom left block prefers the samples left of it
+		}
+		dc := int32(128)
+		switch {
+		case useTop && useLeft:
+			dc = (sumTop + sumLeft + 4) >> 3
+		case useTop:
+			dc = (sumTop + 2) >> 2
+		case useLeft:
+			dc = (sumLeft + 2) >> 2
+		}
+		for py := 0; py < 4; py++ {
+			for px := 0; px < 4; px++ {
+				set(xO+px, yO+py, dc)
+			}
+		}
+	}
+}
+
+// mbEdges returns which edges of a macroblock are available for prediction
+func (d *h264Decoder) mbEdges(addr int) edges {
+	e := edges{}
+	_, _, _, e.hasLeft = d.neighbour(addr, -1, 0, 1)
+	_, _, _, e.hasTop = d.neighbour(addr, 0, -1, 1)
+	_, _, _, e.hasTopLeft = d.neighbour(addr, -1, -1, 1)
+	return e
+}
+
+func (d *h264Decoder) predict16x16(addr int, mode int, x int, y int) error {
+	e := d.mbEdges(addr)
+	loadEdges(d.img.Y, d.img.YStride, x, y, 16, 0, &e)
+	return predictPlane(d.img.Y, d.img.YStride, x, y, 16, mode, &e, false)
+}
+
+func (d *h264Decoder) predictChroma(addr int, mode int, plane []byte, x int, y int) error {
+	e := d.mbEdges(addr)
+	loadEdges(plane, d.img.CStride, x, y, 8, 0, &e)
+	// chroma modes are numbered DC, horizontal, vertical, plane
+	return predictPlane(plane, d.img.CStride, x, y, 8, [4]int{2, 1, 0, 3}[mode], &e, true)
+}
+
+var deblockAlpha = [52]int32{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	4, 4, 5, 6, 7, 8, 9, 10, 12, 13, 15, 17, 20, 22, 25, 28, 32, 36,
+	40, 45, 50, 56, 63, 71, 80, 90, 101, 113, 127, 144, 162, 182, 203, 226, 255, 255,
+}
+
+var deblockBeta = [52]int32{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 6, 6, 7, 7, 8, 8, 9, 9,
+	10, 10, 11, 11, 12, 12, 13, 13, 14, 14, 15, 15, 16, 16, 17, 17, 18, 18,
+}
+
+// tC0 for internal edges of intra macroblocks, where bS is 3
+var deblockTC0 = [52]int32{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 4, 4, 4,
+	5, 6, 6, 7, 8, 9, 10, 11, 13, 14, 16, 18, 20, 23, 25,
+}
+
+func clip3(lo int32, hi int32, v int32) int32 {
+	if v < lo {
+		return lo
+	} else if v > hi {
+		return hi
+	}
+	return v
+}
+
+// deblock applies the loop filter to the whole picture. Every macroblock of an intra
+// picture is intra coded, so macroblock edges are filtered with bS 4 and internal edges with 3.
+func (d *h264Decoder) deblock() {
+	w := d.cur.widthMbs
+	for addr := range d.mbs {
+		mb := &d.mbs[addr]
+		s := d.slices[mb.slice-1]
+		if s.deblocking == 1 {
+			continue
+		}
+		x0, y0 := addr%w*16, addr/w*16
+		for dir := 0; dir < 2; dir++ { // vertical edges, then horizontal
+			for edge := 0; edge < 4; edge++ {
+				bS := 3
+				var nb int
+				if edge == 0 {
+					if dir == 0 && addr%w == 0 || dir == 1 && addr < w {
+						continue
+					}
+					nb = addr - 1
+					if dir == 1 {
+						nb = addr - w
+					}
+					if s.deblocking == 2 && d.mbs[nb].slice != mb.slice {
+						continue
+					}
+					bS = 4
+				} else {
+					nb = addr
+				}
+
+				qpP, qpQ := d.mbs[nb].qp, mb.qp
+				if d.mbs[nb].pcm {
+					qpP = 0
+				}
+				if mb.pcm {
+					qpQ = 0
+				}
+				filterEdge(d.img.Y, d.img.YStride, x0, y0, dir, edge*4, 16, bS, (qpP+qpQ+1)>>1, s, false)
+				if edge%2 == 0 {
+					for c, plane := range [][]byte{d.img.Cb, d.img.Cr} {
+						cP := chromaQP(qpP + s.chromaQPOffset[c])
+						cQ := chromaQP(qpQ + s.chromaQPOffset[c])
+						filterEdge(plane, d.img.CStride, x0/2, y0/2, dir, edge*2, 8, bS, (cP+cQ+1)>>1, s, true)
+					}
+				}
+			}
+		}
+	}
+}
+
+// filterEdge filters the n samples long edge at offset within the block at (x0, y0),
+// vertical if dir is 0 and horizontal if 1
+func filterEdge(plane []byte, stride int, x0 int, y0 int, dir int, offset int, n int, bS int, qp int, s h264Slice, chroma bool) {
+	indexA := int(clip3(0, 51, int32(qp+s.alphaOff)))
+	indexB := int(clip3(0, 51, int32(qp+s.betaOff)))
+	alpha, beta := deblockAlpha[indexA], deblockBeta[indexB]
+	if alpha == 0 || beta == 0 {
+		return
+	}
+
+	// across is the distance between samples across the edge, along between rows of it
+	across, along := 1, stride
+	start := y0*stride + x0 + offset
+	if dir == 1 {
+		across, along = stride, 1
+		start = (y0+offset)*stride + x0
+	}
+	for i := 0; i < n; i++ {
+		q := start + i*along
+		p0, p1 := int32(plane[q-across]), int32(plane[q-2*across])
+		q0, q1 := int32(plane[q]), int32(plane[q+across])
+		if abs32(p0-q0) >= alpha || abs32(p1-p0) >= beta || abs32(q1-q0) >= beta {
+			continue
+		}
+		var p2, q2 int32
+		if !chroma {
+			p2, q2 = int32(plane[q-3*across]), int32(plane[q+2*across])
+		}
+		ap, aq := abs32(p2-p0), abs32(q2-q0)
+
+		if bS < 4 {
+			tc0 := deblockTC0[indexA]
+			tc := tc0 + 1
+			if !chroma {
+				tc = tc0
+				if ap < beta {
+					tc++
+				}
+				if aq < beta {
+					tc++
+				}
+			}
+			delta := clip3(-tc, tc, ((q0-p0)*4+(p1-q1)+4)>>3)
+			plane[q-across] = clip1(p0 + delta)
+			plane[q] = clip1(q0 - delta)
+			if !chroma && ap < beta {
+				plane[q-2*across] = uint8(p1 + clip3(-tc0, tc0, (p2+(p0+q0+1)>>1-p1*2)>>1))
+			}
+			if !chroma && aq < beta {
+				plane[q+across] = uint8(q1 + clip3(-tc0, tc0, (q2+(p0+q0+1)>>1-q1*2)>>1))
+			}
+			continue
+		}
+
+		strong := abs32(p0-q0) < alpha>>2+2
+		if !chroma && ap < beta && strong {
+			p3 := int32(plane[q-4*across])
+			plane[q-across] = uint8((p2 + 2*p1 + 2*p0 + 2*q0 + q1 + 4) >> 3)
+			plane[q-2*across] = uint8((p2 + p1 + p0 + q0 + 2) >> 2)
+			plane[q-3*across] = uint8((2*p3 + 3*p2 + p1 + p0 + q0 + 4) >> 3)
+		} else {
+			plane[q-across] = uint8((2*p1 + p0 + q1 + 2) >> 2)
+		}
+		if !chroma && aq < beta && strong {
+			q3 := int32(plane[q+3*across])
+			plane[q] = uint8((p1 + 2*p0 + 2*q0 + 2*q1 + q2 + 4) >> 3)
+			plane[q+across] = uint8((p0 + q0 + q1 + q2 + 2) >> 2)
+			plane[q+2*across] = uint8((2*q3 + 3*q2 + q1 + q0 + p0 + 4) >> 3)
+		} else {
+			plane[q] = uint8((2*q1 + q0 + p1 + 2) >> 2)
+		}
+	}
+}
+
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,81 @@
+package raspivid
+
+import (
+	"image"
+	"os"
+	"testing"
+)
+
+// testdata/idr.h264 is a 96x76 constrained baseline keyframe in raspivid's stream format,
+// and testdata/idr.yuv the I420 picture the bundled Broadway decoder makes of it.
+func TestDecodeIDR(t *testing.T) {
+	nals, err := keyframeNear("testdata/idr.h264", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("testdata/idr.yuv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := newH264Decoder().decode(nals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stream crops the bottom of its 96x80 macroblocks, which Broadway keeps
+	if img.Rect != image.Rect(0, 0, 96, 76) {
+		t.Fatalf("decoded %v, want 96x76", img.Rect)
+	}
+	const width, height = 96, 80
+	if len(want) != width*height*3/2 {
+		t.Fatalf("reference is %d bytes, want %d", len(want), width*height*3/2)
+	}
+	cb, cr := want[width*height:], want[width*height*5/4:]
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			if got := img.Y[img.YOffset(x, y)]; got != want[y*width+x] {
+				t.Fatalf("luma at %d,%d is %d, want %d", x, y, got, want[y*width+x])
+			}
+			c := y/2*width/2 + x/2
+			if got := img.Cb[img.COffset(x, y)]; got != cb[c] {
+				t.Fatalf("Cb at %d,%d is %d, want %d", x, y, got, cb[c])
+			}
+			if got := img.Cr[img.COffset(x, y)]; got != cr[c] {
+				t.Fatalf("Cr at %d,%d is %d, want %d", x, y, got, cr[c])
+			}
+		}
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	nals, err := keyframeNear("testdata/idr.h264", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace first_mb_in_slice, a single 1 bit for macroblock 0, with the code for 2^32-2,
+	// 31 zeros, a one and 31 ones, which is negative where int is 32 bits.
+	var bits []byte
+	for i := 0; i < 31; i++ {
+		bits = append(bits, 0)
+	}
+	for i := 0; i < 32; i++ {
+		bits = append(bits, 1)
+	}
+	for i := 9; i < len(nals[2])*8; i++ {
+		bits = append(bits, nals[2][i/8]>>uint(7-i%8)&1)
+	}
+	slice := make([]byte, 1+(len(bits)+7)/8)
+	slice[0] = nals[2][0]
+	for i, bit := range bits {
+		slice[1+i/8] |= bit << uint(7-i%8)
+	}
+	if _, err := newH264Decoder().decode([][]byte{nals[0], nals[1], slice}); err == nil {
+		t.Error("decoded a slice with an oversized first macroblock")
+	}
+
+	// truncated slices only need to fail without panicking
+	for i := 1; i < len(nals[2]); i++ {
+		newH264Decoder().decode([][]byte{nals[0], nals[1], nals[2][:i]})
+	}
+}
@@ -0,0 +1,153 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const heatmapSaveInterval = 5 * time.Minute
+
+// heatmapDay is the number of times each motion block triggered, for each hour of a day
+type heatmapDay struct {
+	Cols  int                 `json:"cols"`
+	Rows  int                 `json:"rows"`
+	Hours map[string][]uint32 `json:"hours"` // "00" - "23"
+}
+
+// Heatmap accumulates triggered blocks per hour, saving a file per day
+type Heatmap struct {
+	folder   string
+	cols     int
+	rows     int
+	date     string
+	day      heatmapDay
+	lastSave time.Time
+	lock     sync.Mutex
+}
+
+// HeatmapGrid is the number of times each motion block triggered over a period
+type HeatmapGrid struct {
+	Cols   int      `json:"cols"`
+	Rows   int      `json:"rows"`
+	Counts []uint32 `json:"counts"`
+	Max    uint32   `json:"max"`
+}
+
+func (hm *Heatmap) init(folder string, cols, rows int) {
+	os.MkdirAll(folder, 0700)
+
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+	hm.folder = folder
+	hm.cols = cols
+	hm.rows = rows
+	hm.lastSave = time.Now()
+	hm.loadDay(time.Now().Format("2006-01-02"))
+}
+
+func (hm *Heatmap) file(date string) string {
+	return hm.folder + date + ".json"
+}
+
+func (hm *Heatmap) readDay(date string) (heatmapDay, bool) {
+	day := heatmapDay{}
+	f, err := os.ReadFile(hm.file(date))
+	if err != nil || json.Unmarshal(f, &day) != nil || day.Cols != hm.cols || day.Rows != hm.rows {
+		return day, false
+	}
+	return day, true
+}
+
+// loadDay switches accumulation to date. lock must be held.
+func (hm *Heatmap) loadDay(date string) {
+	day, ok := hm.readDay(date)
+	if !ok || day.Hours == nil {
+		day = heatmapDay{Cols: hm.cols, Rows: hm.rows, Hours: make(map[string][]uint32)}
+	}
+	hm.date = date
+	hm.day = day
+}
+
+// save writes the current day to disk. lock must be held.
+func (hm *Heatmap) save() {
+	hm.lastSave = time.Now()
+	out, err := json.Marshal(hm.day)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(hm.file(hm.date), out, 0600); err != nil {
+		log.Println("Couldn't save heatmap: " + err.Error())
+	}
+}
+
+// add counts the triggered blocks of a frame
+func (hm *Heatmap) add(frame *[]motionVector) {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+
+	if hm.folder == "" || len(*frame) != hm.cols*hm.rows {
+		return
+	}
+
+	now := time.Now()
+	if date := now.Format("2006-01-02"); date != hm.date {
+		hm.save()
+		hm.loadDay(date)
+	}
+
+	hour := now.Format("15")
+	counts := hm.day.Hours[hour]
+	if counts == nil {
+		counts = make([]uint32, len(*frame))
+		hm.day.Hours[hour] = counts
+	}
+	for i, v := range *frame {
+		if v.X != 0 {
+			counts[i]++
+		}
+	}
+
+	if time.Since(hm.lastSave) > heatmapSaveInterval {
+		hm.save()
+	}
+}
+
+// Get sums the counts of the given number of days ending on date.
+// hour limits the sum to one hour of each day, -1 for the whole day.
+func (hm *Heatmap) Get(date time.Time, days int, hour int) HeatmapGrid {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+
+	grid := HeatmapGrid{Cols: hm.cols, Rows: hm.rows, Counts: make([]uint32, hm.cols*hm.rows)}
+	hourName := fmt.Sprintf("%02d", hour)
+	for d := 0; d < days; d++ {
+		name := date.AddDate(0, 0, -d).Format("2006-01-02")
+		day := hm.day
+		if name != hm.date {
+			var ok bool
+			if day, ok = hm.readDay(name); !ok {
+				continue
+			}
+		}
+
+		for h, counts := range day.Hours {
+			if (hour >= 0 && h != hourName) || len(counts) != len(grid.Counts) {
+				continue
+			}
+			for i, n := range counts {
+				grid.Counts[i] += n
+			}
+		}
+	}
+
+	for _, n := range grid.Counts {
+		if n > grid.Max {
+			grid.Max = n
+		}
+	}
+	return grid
+}
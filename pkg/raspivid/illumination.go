@@ -0,0 +1,77 @@
+package raspivid
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// IlluminationFilter suppresses motion detection after frame-wide changes in brightness,
+// like clouds passing over or the IR filter switching
+type IlluminationFilter struct {
+	MaxArea  float64       // fraction of blocks triggered at once that counts as an illumination change, 0 disables
+	SADSpike float64       // ratio of a frame's SAD to its typical SAD that counts as an illumination change, 0 disables
+	Settle   time.Duration // how long to suppress motion after a change
+
+	suppressUntil time.Time
+}
+
+// check reports if motion should be suppressed for the frame, if the frame contains an
+// illumination change, and if its SAD spiked. sadRatio is the frame's SAD relative to the
+// typical SAD at the same position in the keyframe interval, 0 while unknown.
+func (f *IlluminationFilter) check(area float64, sadRatio float64) (suppressed bool, changed bool, sadSpike bool) {
+	if f.MaxArea > 0 && area >= f.MaxArea {
+		changed = true
+	}
+	if f.SADSpike > 0 && sadRatio > f.SADSpike {
+		changed = true
+		sadSpike = true
+	}
+
+	if changed {
+		f.suppressUntil = time.Now().Add(f.Settle)
+	}
+	return changed || time.Now().Before(f.suppressUntil), changed, sadSpike
+}
+
+// MotionMetrics counts motion detection outcomes since startup
+type MotionMetrics struct {
+	Frames              uint64 `json:"frames"`
+	TriggeredFrames     uint64 `json:"triggeredFrames"`     // frames that extended a recording
+	IlluminationChanges uint64 `json:"illuminationChanges"` // frames detected as frame-wide brightness changes
+	SuppressedFrames    uint64 `json:"suppressedFrames"`    // frames ignored while settling after an illumination change
+}
+
+// Metrics returns a snapshot of the motion detection counters
+func (c *Motion) Metrics() MotionMetrics {
+	return MotionMetrics{
+		Frames:              atomic.LoadUint64(&c.metrics.Frames),
+		TriggeredFrames:     atomic.LoadUint64(&c.metrics.TriggeredFrames),
+		IlluminationChanges: atomic.LoadUint64(&c.metrics.IlluminationChanges),
+		SuppressedFrames:    atomic.LoadUint64(&c.metrics.SuppressedFrames),
+	}
+}
+
+// illuminationChanged checks a frame for an illumination change, counting the outcome in metrics.
+// Also reports if the frame's SAD spiked.
+func (c *Motion) illuminationChanged(frame *[]motionVector, sadRatio float64) (bool, bool) {
+	triggered := 0
+	for _, v := range *frame {
+		if v.X != 0 {
+			triggered++
+		}
+	}
+
+	suppressed, changed, sadSpike := c.Illumination.check(float64(triggered)/float64(len(*frame)), sadRatio)
+	if changed {
+		atomic.AddUint64(&c.metrics.IlluminationChanges, 1)
+		if !c.suppressing {
+			log.Println("Illumination change detected, suppressing motion")
+		}
+	}
+	c.suppressing = suppressed
+	if suppressed && triggered > 0 {
+		atomic.AddUint64(&c.metrics.SuppressedFrames, 1)
+	}
+	return suppressed, sadSpike
+}
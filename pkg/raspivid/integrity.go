@@ -0,0 +1,321 @@
+package raspivid
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuarantineFolder holds recordings that failed the integrity check
+const QuarantineFolder = "quarantine/"
+
+// QuarantinedRecording is a recording moved aside by the integrity check
+type QuarantinedRecording struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// IntegrityReport summarizes the integrity check of stored recordings made at startup
+type IntegrityReport struct {
+	Running               bool                   `json:"running"`
+	Started               time.Time              `json:"started"`
+	Finished              time.Time              `json:"finished"`
+	RawChecked            int                    `json:"rawChecked"`
+	RawRepaired           int                    `json:"rawRepaired"` // zero-filled tails left by power loss removed
+	VideosChecked         int                    `json:"videosChecked"`
+	ThumbnailsRegenerated int                    `json:"thumbnailsRegenerated"`
+	Quarantined           []QuarantinedRecording `json:"quarantined"`
+}
+
+// Integrity checks stored recordings and reports what it found
+type Integrity struct {
+	report IntegrityReport
+	lock   sync.Mutex
+}
+
+// Report returns the results of the integrity check
+func (in *Integrity) Report() IntegrityReport {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	r := in.report
+	r.Quarantined = append([]QuarantinedRecording{}, r.Quarantined...)
+	return r
+}
+
+// start marks the integrity check as running
+func (in *Integrity) start() {
+	in.update(func(r *IntegrityReport) {
+		r.Running = true
+		if r.Started.IsZero() {
+			r.Started = time.Now()
+		}
+	})
+}
+
+func (in *Integrity) update(fn func(r *IntegrityReport)) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	fn(&in.report)
+}
+
+// checkH264 validates a raw stream: it must start with an SPS, contain a keyframe, and
+// every NAL unit must have a valid header. A zero-filled tail, as left by a power loss,
+// is truncated away, returning true. The stream is read through a small buffer, so long
+// continuous segments don't have to fit in memory.
+func checkH264(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(r, head); err != nil || !bytes.Equal(head[:4], []byte{0, 0, 0, 1}) ||
+		head[4]&0x80 != 0 || head[4]&0x1f != nalSPS {
+		return false, errors.New("doesn't start with an SPS")
+	}
+
+	size := int64(len(head))
+	end := size // just past the last byte that isn't zero
+	zeros := 0
+	header := false // the next byte is the header of a NAL unit
+	keyframe := false
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return false, err
+		}
+		size++
+
+		if header {
+			if b&0x80 != 0 || b&0x1f == 0 {
+				return false, errors.New("malformed NAL unit")
+			}
+			if b&0x1f == nalIDRSlice {
+				keyframe = true
+			}
+			header = false
+		}
+		if b == 0 {
+			zeros++
+			continue
+		}
+		header = b == 1 && zeros >= 3
+		zeros = 0
+		end = size
+	}
+	if header {
+		return false, errors.New("malformed NAL unit") // start code without a NAL unit
+	}
+	if !keyframe {
+		return false, errors.New("no keyframe")
+	}
+
+	if size-end >= 4 {
+		return true, os.Truncate(path, end)
+	}
+	return false, nil
+}
+
+// checkStoredH264 is a quick check of a stored raw stream that only reads its ends, so
+// startup doesn't read the whole archive. It must start with an SPS and reach a keyframe
+// within its first NAL units, and mustn't end in a zero-filled tail.
+func checkStoredH264(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, 4096)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	head = head[:n]
+	startCode := []byte{0, 0, 0, 1}
+	if len(head) < 5 || !bytes.HasPrefix(head, startCode) || head[4]&0x1f != nalSPS {
+		return errors.New("doesn't start with an SPS")
+	}
+	keyframe := false
+	for i := 0; i+4 < len(head) && !keyframe; {
+		t := head[i+4] & 0x1f
+		if head[i+4]&0x80 != 0 || t == 0 || t == nalSlice {
+			return errors.New("no keyframe at the start")
+		}
+		keyframe = t == nalIDRSlice
+		next := bytes.Index(head[i+4:], startCode)
+		if next < 0 {
+			break
+		}
+		i += 4 + next
+	}
+	if !keyframe {
+		return errors.New("no keyframe at the start")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tail := make([]byte, 4)
+	if _, err := f.ReadAt(tail, info.Size()-int64(len(tail))); err != nil {
+		return err
+	}
+	if bytes.Equal(tail, make([]byte, len(tail))) {
+		return errors.New("zero-filled tail")
+	}
+	return nil
+}
+
+// checkMP4 validates that the top level boxes of an mp4 are complete and include a moov box
+func checkMP4(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	moov := false
+	header := make([]byte, 16)
+	for offset := int64(0); offset < size; {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return errors.New("truncated box header")
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		if boxSize == 1 {
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return errors.New("truncated box header")
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		} else if boxSize == 0 {
+			boxSize = size - offset
+		}
+		if boxSize < headerSize || offset+boxSize > size {
+			return fmt.Errorf("%q box is truncated", boxType)
+		}
+		if boxType == "moov" {
+			moov = true
+		}
+		offset += boxSize
+	}
+
+	if !moov {
+		return errors.New("no moov box")
+	}
+	return nil
+}
+
+// quarantine moves the files of a recording out of the way
+func (in *Integrity) quarantine(folder string, dir string, name string, reason string) {
+	os.MkdirAll(folder+QuarantineFolder, 0700)
+	if err := moveFiles(dir, folder+QuarantineFolder, name); err != nil {
+		log.Println("Couldn't quarantine " + name + ": " + err.Error())
+		return
+	}
+	log.Println("Quarantined " + name + ": " + reason)
+	in.update(func(r *IntegrityReport) {
+		r.Quarantined = append(r.Quarantined, QuarantinedRecording{name, reason})
+	})
+}
+
+// rawLeftovers lists the streams left in dir by a previous run
+func rawLeftovers(dir string) []string {
+	names := []string{}
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if filepath.Ext(strings.ToLower(f.Name())) == ".h264" {
+			names = append(names, strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())))
+		}
+	}
+	return names
+}
+
+// checkRaw checks streams left in dir by a previous run before they're converted
+func (in *Integrity) checkRaw(folder string, dir string, names []string) {
+	for _, name := range names {
+		repaired, err := checkH264(dir + name + ".h264")
+		in.update(func(r *IntegrityReport) {
+			r.RawChecked++
+			if repaired {
+				r.RawRepaired++
+			}
+		})
+		if err != nil {
+			in.quarantine(folder, dir, name, err.Error())
+		}
+	}
+}
+
+// checkStored checks the videos in the dated subfolders of dir, quarantining corrupt ones
+// and recreating missing thumbnails of videos recorded at framerate unless it's 0
+func (in *Integrity) checkStored(rec *Recorder, folder string, dir string, framerate int) {
+	recordings, orphans := rec.scanRecordings(dir, KindEvent)
+	for _, r := range recordings {
+		if recentlyWritten(r) {
+			continue // still being converted
+		}
+		var err error
+		if _, statErr := os.Stat(r.Dir + r.Name + ".mp4"); statErr == nil {
+			err = checkMP4(r.Dir + r.Name + ".mp4")
+		} else {
+			err = checkStoredH264(r.Dir + r.Name + ".h264")
+		}
+		in.update(func(r *IntegrityReport) { r.VideosChecked++ })
+		if err != nil {
+			in.quarantine(folder, r.Dir, r.Name, err.Error())
+			continue
+		}
+
+		if _, err := os.Stat(r.Dir + r.Name + ".jpg"); framerate > 0 && os.IsNotExist(err) {
+			var err error
+			if _, statErr := os.Stat(r.Dir + r.Name + ".mp4"); statErr == nil && rec.hasFfmpeg {
+				err = makeThumbnail(r.Dir+r.Name+".mp4", r.Dir+r.Name+".jpg", 3)
+			} else {
+				err = keyframeThumbnail(r.Dir+r.Name+".h264", r.Dir+r.Name+".jpg", 3, framerate)
+			}
+			if err == nil {
+				in.update(func(r *IntegrityReport) { r.ThumbnailsRegenerated++ })
+			}
+		}
+	}
+
+	for _, o := range orphans {
+		if recentlyWritten(o) {
+			continue
+		}
+		in.quarantine(folder, o.Dir, o.Name, "no video")
+	}
+}
+
+// finish marks the integrity check done and logs a summary
+func (in *Integrity) finish() {
+	in.update(func(r *IntegrityReport) {
+		r.Running = false
+		r.Finished = time.Now()
+		log.Printf("Integrity check: %d raw streams (%d repaired), %d videos, %d thumbnails regenerated, %d quarantined\n",
+			r.RawChecked, r.RawRepaired, r.VideosChecked, r.ThumbnailsRegenerated, len(r.Quarantined))
+	})
+}
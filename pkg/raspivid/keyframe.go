@@ -0,0 +1,165 @@
+package raspivid
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+)
+
+const thumbnailWidth = 600
+
+// splitNALs is a bufio.SplitFunc returning the NAL units of an H.264 stream with
+// 4 byte start codes, without the start codes
+func splitNALs(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	delimiter := []byte{0, 0, 0, 1}
+	start := bytes.Index(data, delimiter)
+	if start < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+	if end := bytes.Index(data[start+4:], delimiter); end >= 0 {
+		return start + 4 + end, data[start+4 : start+4+end], nil
+	}
+	if atEOF {
+		return len(data), data[start+4:], nil
+	}
+	return start, nil, nil
+}
+
+// startsPicture reports if a NAL unit is the first slice of a picture
+func startsPicture(nal []byte) bool {
+	t := nal[0] & 0x1f
+	return (t == nalSlice || t == nalIDRSlice) && len(nal) > 1 && nal[1]&0x80 != 0 // first_mb_in_slice is 0
+}
+
+// keyframeNear returns the NAL units, including parameter sets, of the keyframe in a raw
+// stream nearest to the given frame
+func keyframeNear(path string, frame int) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 1<<20), 16<<20)
+	s.Split(splitNALs)
+
+	var sps, pps []byte
+	var nals [][]byte
+	bestFrame, n := -1, -1
+	collecting := false
+	for s.Scan() {
+		nal := s.Bytes()
+		if len(nal) < 2 {
+			continue
+		}
+		switch t := nal[0] & 0x1f; {
+		case t == nalSPS:
+			sps = append(sps[:0], nal...)
+		case t == nalPPS:
+			pps = append(pps[:0], nal...)
+		case startsPicture(nal):
+			n++
+			collecting = false
+			if t != nalIDRSlice {
+				break
+			}
+			if bestFrame >= 0 && n > frame && n-frame >= frame-bestFrame {
+				return nals, nil // the previous keyframe is nearer
+			}
+			if sps == nil || pps == nil {
+				break
+			}
+			bestFrame = n
+			nals = [][]byte{append([]byte{}, sps...), append([]byte{}, pps...), append([]byte{}, nal...)}
+			collecting = true
+		case t == nalIDRSlice && collecting:
+			nals = append(nals, append([]byte{}, nal...))
+		}
+		if bestFrame >= frame && !collecting {
+			return nals, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if bestFrame < 0 {
+		return nil, errors.New("no keyframe in " + path)
+	}
+	return nals, nil
+}
+
+// scalePlane box filters a plane of sw by sh samples down to w by h
+func scalePlane(sample func(x, y int) uint8, sw int, sh int, dst []byte, stride int, w int, h int) {
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+			sum := 0
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sum += int(sample(sx, sy))
+				}
+			}
+			dst[y*stride+x] = uint8(sum / ((y1 - y0) * (x1 - x0)))
+		}
+	}
+}
+
+// scaleImage scales a picture to the given width, keeping its aspect ratio.
+// Pictures narrower than width are returned as they are.
+func scaleImage(img *image.YCbCr, width int) *image.YCbCr {
+	b := img.Bounds()
+	if width <= 0 || width >= b.Dx() {
+		return img
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	out := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	scalePlane(func(x, y int) uint8 { return img.Y[img.YOffset(b.Min.X+x, b.Min.Y+y)] },
+		b.Dx(), b.Dy(), out.Y, out.YStride, width, height)
+	for _, p := range [][2][]byte{{img.Cb, out.Cb}, {img.Cr, out.Cr}} {
+		src := p[0]
+		scalePlane(func(x, y int) uint8 { return src[img.COffset(b.Min.X+x*2, b.Min.Y+y*2)] },
+			(b.Dx()+1)/2, (b.Dy()+1)/2, p[1], out.CStride, (width+1)/2, (height+1)/2)
+	}
+	return out
+}
+
+// keyframeThumbnail decodes the keyframe of a raw stream nearest skip seconds in and
+// saves it as a jpg, without needing ffmpeg
+func keyframeThumbnail(src string, dst string, skip float64, framerate int) error {
+	nals, err := keyframeNear(src, int(skip*float64(framerate)))
+	if err != nil {
+		return err
+	}
+	img, err := newH264Decoder().decode(nals)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, scaleImage(img, thumbnailWidth), &jpeg.Options{Quality: 75}); err != nil {
+		f.Close()
+		os.Remove(dst)
+		return err
+	}
+	return f.Close()
+}
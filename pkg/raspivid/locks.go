@@ -0,0 +1,171 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Locks are recordings protected from automatic deletion
+type Locks struct {
+	MaxBytes uint64 // cap on the total size of locked recordings, 0 for no cap
+	Archive  string // second storage tier locked recordings may be in
+
+	locked  map[string]bool
+	folder  string
+	warning string
+	lock    sync.Mutex
+}
+
+// LockState lists the locked recordings and their total size
+type LockState struct {
+	Locked   []string `json:"locked"`
+	Bytes    uint64   `json:"bytes"`
+	MaxBytes uint64   `json:"maxBytes"`
+	Warning  string   `json:"warning"` // set when locked recordings prevent keeping enough free space
+}
+
+// Load reads previously locked recordings from folder/locks.json.
+// folder must include the trailing slash.
+func (l *Locks) Load(folder string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.folder = folder
+	l.locked = make(map[string]bool)
+
+	f, err := os.ReadFile(folder + "locks.json")
+	if err != nil {
+		return
+	}
+	names := []string{}
+	if err := json.Unmarshal(f, &names); err != nil {
+		log.Println("Couldn't load locked recordings: " + err.Error())
+		return
+	}
+	for _, name := range names {
+		l.locked[name] = true
+	}
+	log.Printf("%d locked recordings\n", len(names))
+}
+
+// save writes the locked recordings to disk. lock must be held.
+func (l *Locks) save() error {
+	out, err := json.Marshal(l.names())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(l.folder+"locks.json", out, 0600)
+}
+
+// names returns the locked recordings in order. lock must be held.
+func (l *Locks) names() []string {
+	names := []string{}
+	for name := range l.locked {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recordingSize returns the size of the files of a recording or segment
+func (l *Locks) recordingSize(name string) uint64 {
+	dirs := []string{l.folder + TrashFolder}
+	if s := strings.Split(name, "-"); len(s) > 2 {
+		dirs = append(dirs, l.folder+s[0]+"-"+s[1]+"/")
+	}
+	if len(name) >= len("2006-01-02") {
+		dirs = append(dirs, segmentDayFolder(l.folder+ContinuousFolder, name))
+	}
+
+	if l.Archive != "" {
+		for _, dir := range dirs[1:] {
+			dirs = append(dirs, l.Archive+strings.TrimPrefix(dir, l.folder))
+		}
+	}
+
+	var size uint64
+	for _, dir := range dirs {
+		for _, ext := range recordingExtensions {
+			if info, err := os.Stat(dir + name + ext); err == nil {
+				size += uint64(info.Size())
+			}
+		}
+	}
+	return size
+}
+
+// lockedBytes returns the total size of locked recordings. lock must be held.
+func (l *Locks) lockedBytes() uint64 {
+	var total uint64
+	for name := range l.locked {
+		total += l.recordingSize(name)
+	}
+	return total
+}
+
+// IsLocked reports if a recording is protected from automatic deletion
+func (l *Locks) IsLocked(name string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.locked[name]
+}
+
+// Lock protects a recording from automatic deletion, unless that would exceed MaxBytes
+func (l *Locks) Lock(name string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.locked[name] {
+		return nil
+	}
+	size := l.recordingSize(name)
+	if size == 0 {
+		return os.ErrNotExist
+	}
+	if total := l.lockedBytes(); l.MaxBytes > 0 && total+size > l.MaxBytes {
+		return fmt.Errorf("locking %s would exceed the %d KiB limit on locked recordings (%d KiB locked)",
+			name, l.MaxBytes/1024, total/1024)
+	}
+
+	l.locked[name] = true
+	return l.save()
+}
+
+// Unlock allows a recording to be deleted automatically again
+func (l *Locks) Unlock(name string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.locked[name] {
+		return nil
+	}
+	delete(l.locked, name)
+	l.warning = ""
+	return l.save()
+}
+
+// State returns the locked recordings and their total size
+func (l *Locks) State() LockState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return LockState{l.names(), l.lockedBytes(), l.MaxBytes, l.warning}
+}
+
+// warn reports that locked recordings prevent keeping enough free space, or clears the
+// warning when msg is empty
+func (l *Locks) warn(msg string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.warning != msg && msg != "" {
+		log.Println(msg)
+	}
+	l.warning = msg
+}
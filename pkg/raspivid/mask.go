@@ -0,0 +1,324 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxMaskHistory = 20 // number of previous masks to keep
+
+var validMaskName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// MaskGrid is a motion mask along with the dimensions of the grid it was drawn on.
+// Cells are 1 where motion is detected and 0 where it's ignored.
+type MaskGrid struct {
+	ID    string    `json:"id,omitempty"`
+	Name  string    `json:"name,omitempty"`
+	Cols  int       `json:"cols"`
+	Rows  int       `json:"rows"`
+	Cells []int     `json:"cells"`
+	Saved time.Time `json:"saved"`
+}
+
+func (g *MaskGrid) bytes() []byte {
+	out := make([]byte, len(g.Cells))
+	for i, v := range g.Cells {
+		if v != 0 {
+			out[i] = 1
+		}
+	}
+	return out
+}
+
+func (g *MaskGrid) validate() error {
+	if g.Cols < 1 || g.Rows < 1 {
+		return errors.New("mask cols and rows must be greater than 0")
+	}
+	if len(g.Cells) != g.Cols*g.Rows {
+		return fmt.Errorf("mask has %d cells, expected %d for a %dx%d grid", len(g.Cells), g.Cols*g.Rows, g.Cols, g.Rows)
+	}
+	return nil
+}
+
+func newMaskGrid(mask []byte, cols, rows int) MaskGrid {
+	g := MaskGrid{Cols: cols, Rows: rows, Cells: make([]int, len(mask)), Saved: time.Now()}
+	for i, v := range mask {
+		g.Cells[i] = int(v)
+	}
+	return g
+}
+
+// rescaleMask resizes a mask to a new grid using the nearest cell
+func rescaleMask(g MaskGrid, cols, rows int) []byte {
+	out := make([]byte, cols*rows)
+	src := g.bytes()
+	for y := 0; y < rows; y++ {
+		srcY := y * g.Rows / rows
+		for x := 0; x < cols; x++ {
+			srcX := x * g.Cols / cols
+			out[y*cols+x] = src[srcY*g.Cols+srcX]
+		}
+	}
+	return out
+}
+
+// guessMaskGrid finds the grid a mask without saved dimensions was most likely drawn on,
+// preferring the aspect ratio closest to the current grid
+func guessMaskGrid(mask []byte, cols, rows int) (MaskGrid, bool) {
+	best := MaskGrid{}
+	bestDiff := -1.0
+	aspect := float64(cols) / float64(rows)
+	for c := 1; c <= len(mask); c++ {
+		if len(mask)%c != 0 {
+			continue
+		}
+		r := len(mask) / c
+		diff := float64(c)/float64(r) - aspect
+		if diff < 0 {
+			diff = -diff
+		}
+		if bestDiff < 0 || diff < bestDiff {
+			bestDiff = diff
+			best = newMaskGrid(mask, c, r)
+		}
+	}
+	return best, bestDiff >= 0 && bestDiff < .1
+}
+
+func (c *Motion) maskFolder() string {
+	return c.RecordingFolder + "masks/"
+}
+
+func (c *Motion) maskHistoryFolder() string {
+	return c.RecordingFolder + "masks/history/"
+}
+
+// GetMask returns the current motion mask. An unset mask detects motion everywhere.
+func (c *Motion) GetMask() MaskGrid {
+	cols, rows := c.GridSize()
+
+	c.detectLock.Lock()
+	mask := c.MotionMask
+	c.detectLock.Unlock()
+
+	if len(mask) == 0 {
+		mask = make([]byte, cols*rows)
+		for i := range mask {
+			mask[i] = 1
+		}
+	}
+	return newMaskGrid(mask, cols, rows)
+}
+
+// ApplyMask applies a mask to ignore specified motion blocks.
+// The previous mask is kept in the mask history.
+func (c *Motion) ApplyMask(mask []byte) error {
+	cols, rows := c.GridSize()
+	if len(mask) != cols*rows {
+		return fmt.Errorf("mask has %d cells, expected %d for a %dx%d grid", len(mask), cols*rows, cols, rows)
+	}
+
+	c.detectLock.Lock()
+	prev := c.MotionMask
+	c.MotionMask = mask
+	c.detectLock.Unlock()
+
+	if len(prev) == len(mask) {
+		c.addMaskHistory(newMaskGrid(prev, cols, rows))
+	}
+
+	g := newMaskGrid(mask, cols, rows)
+	out, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.RecordingFolder+"motionMask.json", out, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(c.RecordingFolder+"motionMask.bin", mask, 0600)
+}
+
+// SetMask applies a mask drawn on the current grid
+func (c *Motion) SetMask(g MaskGrid) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+	cols, rows := c.GridSize()
+	if g.Cols != cols || g.Rows != rows {
+		return fmt.Errorf("mask is %dx%d, expected %dx%d", g.Cols, g.Rows, cols, rows)
+	}
+	return c.ApplyMask(g.bytes())
+}
+
+// applyMaskGrid applies a mask, rescaling it if it was drawn on a different grid
+func (c *Motion) applyMaskGrid(g MaskGrid) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+	cols, rows := c.GridSize()
+	if g.Cols != cols || g.Rows != rows {
+		log.Printf("Rescaling motion mask from %dx%d to %dx%d\n", g.Cols, g.Rows, cols, rows)
+		return c.ApplyMask(rescaleMask(g, cols, rows))
+	}
+	return c.ApplyMask(g.bytes())
+}
+
+// ApplyPreviousMask applies the previously registered motion mask,
+// rescaling it if the resolution or block width has changed
+func (c *Motion) ApplyPreviousMask() {
+	cols, rows := c.GridSize()
+
+	g, err := readMaskFile(c.RecordingFolder + "motionMask.json")
+	if err != nil { // masks saved before grid dimensions were recorded
+		f, err := os.ReadFile(c.RecordingFolder + "motionMask.bin")
+		if err != nil {
+			log.Printf("Couldn't load motion mask")
+			return
+		}
+
+		ok := true
+		if len(f) == cols*rows {
+			g = newMaskGrid(f, cols, rows)
+		} else {
+			g, ok = guessMaskGrid(f, cols, rows)
+		}
+		if !ok {
+			log.Printf("Couldn't apply previous motion mask due to changed resolution")
+			return
+		}
+	}
+
+	if g.Cols == cols && g.Rows == rows {
+		c.detectLock.Lock()
+		c.MotionMask = g.bytes()
+		c.detectLock.Unlock()
+	} else if err := c.applyMaskGrid(g); err != nil {
+		log.Println("Couldn't apply previous motion mask: " + err.Error())
+		return
+	}
+	log.Printf("Previously registered motion mask has been applied")
+}
+
+func readMaskFile(file string) (MaskGrid, error) {
+	g := MaskGrid{}
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return g, err
+	}
+	if err := json.Unmarshal(f, &g); err != nil {
+		return g, err
+	}
+	return g, g.validate()
+}
+
+func writeMaskFile(file string, g MaskGrid) error {
+	os.MkdirAll(filepath.Dir(file), 0700)
+	out, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, out, 0600)
+}
+
+func listMaskFiles(folder string) []MaskGrid {
+	files, err := os.ReadDir(folder)
+	if err != nil {
+		return []MaskGrid{}
+	}
+
+	masks := []MaskGrid{}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		g, err := readMaskFile(folder + f.Name())
+		if err != nil {
+			continue
+		}
+		g.ID = strings.TrimSuffix(f.Name(), ".json")
+		masks = append(masks, g)
+	}
+	return masks
+}
+
+func (c *Motion) addMaskHistory(g MaskGrid) {
+	folder := c.maskHistoryFolder()
+	if err := writeMaskFile(folder+strconv.FormatInt(time.Now().UnixNano(), 10)+".json", g); err != nil {
+		log.Println("Couldn't save mask history: " + err.Error())
+		return
+	}
+
+	history := c.MaskHistory()
+	for i := maxMaskHistory; i < len(history); i++ {
+		os.Remove(folder + history[i].ID + ".json")
+	}
+}
+
+// MaskHistory lists previously applied masks, newest first
+func (c *Motion) MaskHistory() []MaskGrid {
+	history := listMaskFiles(c.maskHistoryFolder())
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].ID > history[j].ID
+	})
+	return history
+}
+
+// RestoreMask applies a mask from the history. Unknown ids return an os.ErrNotExist error.
+func (c *Motion) RestoreMask(id string) error {
+	if !validMaskName.MatchString(id) {
+		return fmt.Errorf("invalid mask id: %w", os.ErrNotExist)
+	}
+	g, err := readMaskFile(c.maskHistoryFolder() + id + ".json")
+	if err != nil {
+		return err
+	}
+	return c.applyMaskGrid(g)
+}
+
+// SavedMasks lists masks saved by name
+func (c *Motion) SavedMasks() []MaskGrid {
+	masks := listMaskFiles(c.maskFolder())
+	for i := range masks {
+		masks[i].Name = masks[i].ID
+	}
+	return masks
+}
+
+// SaveMask stores the current mask under a name
+func (c *Motion) SaveMask(name string) error {
+	if !validMaskName.MatchString(name) {
+		return errors.New("mask names may only contain letters, numbers, - and _")
+	}
+	g := c.GetMask()
+	g.Name = name
+	return writeMaskFile(c.maskFolder()+name+".json", g)
+}
+
+// ApplySavedMask applies a mask saved by name. Unknown names return an os.ErrNotExist error.
+func (c *Motion) ApplySavedMask(name string) error {
+	if !validMaskName.MatchString(name) {
+		return fmt.Errorf("invalid mask name: %w", os.ErrNotExist)
+	}
+	g, err := readMaskFile(c.maskFolder() + name + ".json")
+	if err != nil {
+		return err
+	}
+	return c.applyMaskGrid(g)
+}
+
+// DeleteSavedMask removes a mask saved by name. Unknown names return an os.ErrNotExist error.
+func (c *Motion) DeleteSavedMask(name string) error {
+	if !validMaskName.MatchString(name) {
+		return fmt.Errorf("invalid mask name: %w", os.ErrNotExist)
+	}
+	return os.Remove(c.maskFolder() + name + ".json")
+}
@@ -0,0 +1,121 @@
+package raspivid
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ricochet2200/go-disk-usage/du"
+)
+
+const moverInterval = time.Minute
+
+// Mover migrates finished recordings from the recording folder to a second, usually
+// larger and slower, storage tier with the same layout
+type Mover struct {
+	Archive      string        // second tier folder, with the trailing slash
+	After        time.Duration // move recordings older than this, 0 to only move for space
+	MinFreeSpace uint64        // move the oldest recordings while the first tier has less free, 0 to only move by age
+}
+
+// moveFile renames a file, copying it when the destination is on another file system
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil || os.IsNotExist(err) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// moveRecording moves the files of a recording to the same place in the archive.
+// The video goes last, so a recording is only complete in the archive once its video is.
+func (m *Mover) moveRecording(folder string, r storedRecording) error {
+	rel := strings.TrimPrefix(r.Dir, folder)
+	if err := os.MkdirAll(m.Archive+rel, 0700); err != nil {
+		return err
+	}
+	for _, ext := range append(append([]string{".json"}, thumbnailExtensions...), ".mp4", ".h264") {
+		if err := moveFile(r.Dir+r.Name+ext, m.Archive+rel+r.Name+ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recentlyWritten reports if a recording may still be being converted
+func recentlyWritten(r storedRecording) bool {
+	for _, ext := range recordingExtensions {
+		if info, err := os.Stat(r.Dir + r.Name + ext); err == nil && time.Since(info.ModTime()) < time.Minute {
+			return true
+		}
+	}
+	return false
+}
+
+// move migrates the recordings that are due, oldest first
+func (m *Mover) move(rec *Recorder, folder string) {
+	recordings := rec.listRecordings(folder)
+	freeSpace := du.NewDiskUsage(folder).Available()
+
+	moved := 0
+	for _, r := range recordings {
+		old := m.After > 0 && time.Since(r.Time) > m.After
+		lowSpace := m.MinFreeSpace > 0 && freeSpace < m.MinFreeSpace
+		if !old && !lowSpace || recentlyWritten(r) {
+			continue
+		}
+		if rec.Offload != nil && rec.Offload.IsQueued(r.Name) {
+			continue // the uploader reads it from the recording folder
+		}
+		if err := m.moveRecording(folder, r); err != nil {
+			log.Println("Couldn't move " + r.Name + " to " + m.Archive + ": " + err.Error())
+			return
+		}
+		moved++
+		if lowSpace {
+			freeSpace = du.NewDiskUsage(folder).Available()
+		}
+	}
+
+	if moved > 0 {
+		log.Printf("Moved %d recordings to %s\n", moved, m.Archive)
+		removeEmptyFolders(folder)
+		removeEmptyFolders(folder + ContinuousFolder)
+	}
+}
+
+// Start migrates recordings in the background. folder must include the trailing slash.
+func (m *Mover) Start(rec *Recorder, folder string) {
+	os.MkdirAll(m.Archive, 0700)
+	for {
+		m.move(rec, folder)
+		rec.maintainArchive()
+		time.Sleep(moverInterval)
+	}
+}
@@ -0,0 +1,203 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	offloadPollInterval = 5 * time.Second
+	offloadMinBackoff   = 30 * time.Second
+	offloadMaxBackoff   = time.Hour
+)
+
+// OffloadItem is a recording waiting to be uploaded
+type OffloadItem struct {
+	Name      string    `json:"name"`
+	Folder    string    `json:"folder"` // day folder, relative to the recording folder
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"nextTry"`
+	LastError string    `json:"lastError"`
+}
+
+// Offload uploads each finished recording, with its thumbnail and metadata, to a remote store
+type Offload struct {
+	Target         string // s3://bucket/prefix, sftp://user@host:port/path, or an http(s):// WebDAV URL
+	S3Endpoint     string // defaults to AWS, set for other S3-compatible stores
+	S3Region       string
+	AccessKey      string
+	SecretKey      string
+	BytesPerSecond int64 // upload bandwidth limit, 0 for no limit
+	DeleteLocal    bool  // delete unlocked recordings once uploaded
+
+	uploader uploader
+	locks    *Locks
+	folder   string
+	queue    []OffloadItem
+	lock     sync.Mutex
+}
+
+// Init checks the target and loads uploads left queued by a previous run.
+// folder must include the trailing slash.
+func (o *Offload) Init(folder string, locks *Locks) error {
+	up, err := newUploader(o)
+	if err != nil {
+		return err
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.uploader = up
+	o.locks = locks
+	o.folder = folder
+	o.queue = []OffloadItem{}
+
+	f, err := os.ReadFile(o.file())
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(f, &o.queue); err != nil {
+		log.Println("Couldn't load offload queue: " + err.Error())
+	}
+	if len(o.queue) > 0 {
+		log.Printf("%d recordings waiting to be offloaded\n", len(o.queue))
+	}
+	return nil
+}
+
+func (o *Offload) file() string {
+	return o.folder + "offload.json"
+}
+
+// save writes the queue to disk. lock must be held.
+func (o *Offload) save() {
+	out, err := json.MarshalIndent(o.queue, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(o.file(), out, 0600); err != nil {
+		log.Println("Couldn't save offload queue: " + err.Error())
+	}
+}
+
+// Enqueue queues a converted recording for upload. folder is where it is stored, relative
+// to the recording folder.
+func (o *Offload) Enqueue(folder string, name string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.queue = append(o.queue, OffloadItem{Name: name, Folder: folder, NextTry: time.Now()})
+	o.save()
+}
+
+// Queue returns the recordings waiting to be uploaded
+func (o *Offload) Queue() []OffloadItem {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return append([]OffloadItem{}, o.queue...)
+}
+
+// IsQueued reports if a recording is waiting to be uploaded
+func (o *Offload) IsQueued(name string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, v := range o.queue {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the first upload that is due
+func (o *Offload) next() (OffloadItem, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, v := range o.queue {
+		if !time.Now().Before(v.NextTry) {
+			return v, true
+		}
+	}
+	return OffloadItem{}, false
+}
+
+// finish removes an upload from the queue, or schedules a retry if it failed
+func (o *Offload) finish(item OffloadItem, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for i, v := range o.queue {
+		if v.Name != item.Name {
+			continue
+		}
+		if err == nil {
+			o.queue = append(o.queue[:i], o.queue[i+1:]...)
+		} else {
+			backoff := offloadMinBackoff << v.Attempts
+			if backoff > offloadMaxBackoff || backoff <= 0 {
+				backoff = offloadMaxBackoff
+			}
+			o.queue[i].Attempts++
+			o.queue[i].NextTry = time.Now().Add(backoff)
+			o.queue[i].LastError = err.Error()
+		}
+		break
+	}
+	o.save()
+}
+
+// upload sends the files of a recording, video last so its presence marks a complete upload
+func (o *Offload) upload(item OffloadItem) error {
+	dir := o.folder + item.Folder
+	for _, ext := range append([]string{".json"}, thumbnailExtensions...) {
+		if _, err := os.Stat(dir + item.Name + ext); os.IsNotExist(err) {
+			continue
+		}
+		if err := o.uploader.upload(dir+item.Name+ext, item.Folder+item.Name+ext, o.BytesPerSecond); err != nil {
+			return err
+		}
+	}
+	video := videoFile(dir, item.Name)
+	if video == "" {
+		return errors.New("video is missing")
+	}
+	return o.uploader.upload(dir+video, item.Folder+video, o.BytesPerSecond)
+}
+
+// Start uploads queued recordings, retrying failures with increasing delays
+func (o *Offload) Start() {
+	for {
+		item, ok := o.next()
+		if !ok {
+			time.Sleep(offloadPollInterval)
+			continue
+		}
+
+		if videoFile(o.folder+item.Folder, item.Name) == "" {
+			log.Println("Recording " + item.Name + " is gone, not offloading it")
+			o.finish(item, nil)
+			continue
+		}
+
+		err := o.upload(item)
+		o.finish(item, err)
+		if err != nil {
+			log.Println("Couldn't offload " + item.Name + ": " + err.Error())
+			continue
+		}
+		log.Println("Offloaded " + item.Name)
+
+		if o.DeleteLocal && !o.locks.IsLocked(item.Name) {
+			for _, ext := range recordingExtensions {
+				os.Remove(o.folder + item.Folder + item.Name + ext)
+			}
+		}
+	}
+}
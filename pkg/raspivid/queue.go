@@ -0,0 +1,209 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	PriorityLeftover = 0 // streams left by a previous run
+	PriorityEvent    = 1 // events just recorded
+)
+
+// ConversionItem is a recording waiting to be converted
+type ConversionItem struct {
+	Name      string    `json:"name"`
+	Highlight float64   `json:"highlight"` // seconds into the clip shown in the thumbnail
+	Priority  int       `json:"priority"`
+	Queued    time.Time `json:"queued"`
+}
+
+// ConversionStatus describes the conversion queue
+type ConversionStatus struct {
+	Workers   int              `json:"workers"`
+	Active    []ConversionItem `json:"active"`
+	Pending   []ConversionItem `json:"pending"`
+	Converted int              `json:"converted"` // since startup
+}
+
+// ConversionQueue converts finished recordings with at most Workers conversions at once,
+// new events before leftovers and otherwise in the order they were queued. Queued
+// recordings are saved so they keep their thumbnail time across restarts.
+type ConversionQueue struct {
+	Workers int
+
+	converter *Converter
+	folder    string
+	pending   []ConversionItem
+	active    []ConversionItem
+	converted int
+	lock      sync.Mutex
+	wake      *sync.Cond
+	maintain  chan struct{}
+}
+
+// load reads the recordings left queued by a previous run. folder must include the trailing slash.
+func (q *ConversionQueue) load(conv *Converter, folder string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.converter = conv
+	q.folder = folder
+	q.pending = []ConversionItem{}
+	q.wake = sync.NewCond(&q.lock)
+	q.maintain = make(chan struct{}, 1)
+
+	f, err := os.ReadFile(q.file())
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(f, &q.pending); err != nil {
+		log.Println("Couldn't load conversion queue: " + err.Error())
+	}
+}
+
+func (q *ConversionQueue) file() string {
+	return q.folder + "conversions.json"
+}
+
+// save writes the pending and active conversions to disk. lock must be held.
+func (q *ConversionQueue) save() {
+	out, err := json.MarshalIndent(append(append([]ConversionItem{}, q.active...), q.pending...), "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(q.file(), out, 0600); err != nil {
+		log.Println("Couldn't save conversion queue: " + err.Error())
+	}
+}
+
+// queued reports if a recording is pending or being converted. lock must be held.
+func (q *ConversionQueue) queued(name string) bool {
+	for _, v := range q.active {
+		if v.Name == name {
+			return true
+		}
+	}
+	for _, v := range q.pending {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Enqueue queues a recording in raw/ for conversion, with its thumbnail taken highlight
+// seconds in
+func (q *ConversionQueue) Enqueue(name string, highlight float64, priority int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.queued(name) {
+		return
+	}
+	q.pending = append(q.pending, ConversionItem{Name: name, Highlight: highlight, Priority: priority, Queued: time.Now()})
+	q.save()
+	q.wake.Signal()
+}
+
+// enqueueLeftovers queues streams left in raw/ by a previous run that weren't saved in the queue
+func (q *ConversionQueue) enqueueLeftovers(names []string) {
+	for _, name := range names {
+		if _, err := os.Stat(q.folder + "raw/" + name + ".h264"); err == nil {
+			q.Enqueue(name, 3, PriorityLeftover)
+		}
+	}
+}
+
+// next waits for the most urgent pending conversion and marks it active
+func (q *ConversionQueue) next() ConversionItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.pending) == 0 {
+		q.wake.Wait()
+	}
+	sort.SliceStable(q.pending, func(i, j int) bool {
+		if q.pending[i].Priority != q.pending[j].Priority {
+			return q.pending[i].Priority > q.pending[j].Priority
+		}
+		return q.pending[i].Queued.Before(q.pending[j].Queued)
+	})
+	item := q.pending[0]
+	q.pending = q.pending[1:]
+	q.active = append(q.active, item)
+	q.save()
+	return item
+}
+
+// finish removes a conversion from the active list
+func (q *ConversionQueue) finish(item ConversionItem, converted bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i, v := range q.active {
+		if v.Name == item.Name {
+			q.active = append(q.active[:i], q.active[i+1:]...)
+			break
+		}
+	}
+	if converted {
+		q.converted++
+	}
+	q.save()
+}
+
+// Status returns the pending and active conversions
+func (q *ConversionQueue) Status() ConversionStatus {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return ConversionStatus{
+		Workers:   q.Workers,
+		Active:    append([]ConversionItem{}, q.active...),
+		Pending:   append([]ConversionItem{}, q.pending...),
+		Converted: q.converted,
+	}
+}
+
+// requestMaintenance frees space after a conversion, merging requests made while
+// maintenance is already running
+func (q *ConversionQueue) requestMaintenance() {
+	select {
+	case q.maintain <- struct{}{}:
+	default:
+	}
+}
+
+// start runs the conversion workers and the maintenance they request
+func (q *ConversionQueue) start(rec *Recorder) {
+	workers := q.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				item := q.next()
+				_, err := os.Stat(q.folder + "raw/" + item.Name + ".h264")
+				if err == nil {
+					q.converter.convertFile(item.Name, item.Highlight)
+				} else {
+					log.Println("Recording " + item.Name + " is gone, not converting it")
+				}
+				q.finish(item, err == nil)
+				q.requestMaintenance()
+			}
+		}()
+	}
+
+	go func() {
+		for range q.maintain {
+			rec.Maintenance(q.folder)
+		}
+	}()
+}
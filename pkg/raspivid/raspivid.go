@@ -25,6 +25,11 @@ type Camera struct {
 	ListenPortMotion                                                 string
 }
 
+// KeyframeInterval returns the number of frames between I-frames
+func (c *Camera) KeyframeInterval() int {
+	return *c.Fps * 2
+}
+
 func (c *Camera) getRaspividArgs() []string {
 	params := []string{
 		"-t", "0",
@@ -39,7 +44,7 @@ func (c *Camera) getRaspividArgs() []string {
 		"-b", strconv.Itoa(*c.Bitrate),
 		"-md", strconv.Itoa(*c.SensorMode),
 		"-pf", "baseline",
-		"-g", strconv.Itoa(*c.Fps * 2), // I-frame interval
+		"-g", strconv.Itoa(c.KeyframeInterval()),
 		"-ih", //"-stm",
 		"-a", "1028",
 		"-a", "%Y-%m-%d %l:%M:%S %P",
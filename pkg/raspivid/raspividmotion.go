@@ -18,7 +18,8 @@ Usage:
 import (
 	"bufio"
 	"log"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"sentry-picam/broker"
@@ -27,16 +28,26 @@ import (
 const ignoreFirstFrames = 10 // give camera's autoexposure some time to settle
 // Motion stores configuration parameters and forms the basis for Detect
 type Motion struct {
-	Width           int
-	Height          int
-	SenseThreshold  int8
-	BlockWidth      int
-	Protocol        string
-	ListenPort      string
-	MotionMask      []byte
-	output          []byte
-	recorder        *Recorder
-	RecordingFolder string
+	Width            int
+	Height           int
+	SenseThreshold   int8
+	BlockWidth       int
+	Protocol         string
+	ListenPort       string
+	MotionMask       []byte
+	output           []byte
+	recorder         *Recorder
+	RecordingFolder  string
+	Zones            []MotionZone
+	NotifyScript     string // run with the zone name when a notify-only zone is triggered
+	Filter           MotionFilter
+	Illumination     IlluminationFilter
+	SAD              SADCriterion
+	KeyframeInterval int // frames between keyframes, the -g parameter of raspivid
+	Tracker          Tracker
+	Tripwires        Tripwires
+	Adaptive         AdaptiveModel
+	Heatmap          Heatmap
 
 	rowCount       int
 	colCount       int
@@ -46,25 +57,41 @@ type Motion struct {
 	usableCols     int
 	highlightDistX int
 	highlightDistY int
+
+	zoneIndex  []int      // zone of each motion block, -1 if none
+	zoneCounts []int      // triggered blocks per zone in the current frame
+	detectLock sync.Mutex // guards the mask and zones used by condenseBlocksDirection
+	lastNotify map[string]time.Time
+
+	metrics     MotionMetrics
+	suppressing bool // suppressing motion after an illumination change
+
+	sadBaseline  sadBaseline
+	sadScale     float64 // converts SAD of the current frame to normalized SAD
+	keyframeSeen uint32  // set by WatchKeyframes, read atomically
+
+	blobs blobFinder
 }
 
 // motionVector from raspivid.
 // Ignoring Y since it might be redundant
-// SAD Might be unusable since it periodically spikes
+// SAD periodically spikes around keyframes, see sadBaseline
 const sizeofMotionVector = 4 // size of a motion vector in bytes
 type motionVector struct {
-	X int8
-	Y int8
-	//SAD int16 // Sum of Absolute Difference.
+	X   int8
+	Y   int8
+	SAD uint16 // Sum of Absolute Difference.
 }
 
 type mVhelper struct {
 	tX, tY, tXn, tYn int8 // counters for increasing and decreasing X/Y vectors
 	count            int
+	sad              uint32
 }
 
 func (mV *mVhelper) add(v motionVector) {
 	mV.count++
+	mV.sad += uint32(v.SAD)
 
 	if v.X > 0 {
 		mV.tX++
@@ -78,21 +105,23 @@ func (mV *mVhelper) add(v motionVector) {
 	}
 }
 
-// getAvg figures out if the motion vectors are in the same general direction
-func (mV *mVhelper) getAvg(threshold int8) motionVector {
-	if (mV.tX >= threshold || mV.tXn >= threshold) &&
-		(mV.tY >= threshold || mV.tYn >= threshold) {
+// getAvg figures out if the motion vectors are in the same general direction,
+// optionally combined with the block's SAD
+func (mV *mVhelper) getAvg(threshold int8, sadScale float64, crit *SADCriterion) motionVector {
+	direction := (mV.tX >= threshold || mV.tXn >= threshold) &&
+		(mV.tY >= threshold || mV.tYn >= threshold)
 
+	if mV.sadTriggered(direction, threshold, sadScale, crit) {
 		return motionVector{
 			1,
 			1,
-			//int16(mV.SAD),
+			uint16(mV.sad / uint32(mV.count)),
 		}
 	}
 	return motionVector{
 		0,
 		0,
-		//0,
+		0,
 	}
 }
 
@@ -102,41 +131,15 @@ func (mV *mVhelper) reset() {
 	mV.tXn = 0
 	mV.tY = 0
 	mV.tYn = 0
-}
-
-// ApplyMask applies a mask to ignore specified motion blocks
-func (c *Motion) ApplyMask(mask []byte) {
-	c.MotionMask = mask
-
-	f, _ := os.Create(c.RecordingFolder + "motionMask.bin")
-	f.Write(mask)
-	defer f.Close()
-}
-
-// ApplyPreviousMask applies the previously registered motion mask
-func (c *Motion) ApplyPreviousMask() {
-	f, err := os.ReadFile(c.RecordingFolder + "motionMask.bin")
-	if err != nil {
-		log.Printf("Couldn't load motion mask")
-		return
-	}
-
-	rowCount := c.Height / 16
-	colCount := (c.Width + 16) / 16
-	usableCols := colCount - 1
-
-	maskLength := (usableCols / c.BlockWidth) * (rowCount / c.BlockWidth)
-	if len(f) == maskLength {
-		c.MotionMask = f
-		log.Printf("Previously registered motion mask has been applied")
-	} else {
-		log.Printf("Couldn't apply previous motion mask due to changed resolution")
-	}
+	mV.sad = 0
 }
 
 // condenseBlocksDirection takes a blockWidth * blockWidth average of macroblocks from buf and stores the
 // condensed result into frame
 func (c *Motion) condenseBlocksDirection(frame *[]motionVector, buf *[]motionVector) {
+	c.detectLock.Lock()
+	defer c.detectLock.Unlock()
+
 	mV := make([]mVhelper, c.usableCols/c.BlockWidth)
 	i := 0
 	compressedIndex := 0
@@ -158,15 +161,18 @@ func (c *Motion) condenseBlocksDirection(frame *[]motionVector, buf *[]motionVec
 		if x%c.BlockWidth == 0 {
 			for idx, v := range mV {
 				if len(c.MotionMask) > 0 && c.MotionMask[compressedIndex] == 0 {
-					(*frame)[compressedIndex] = motionVector{0, 0}
+					(*frame)[compressedIndex] = motionVector{}
 				} else {
-					(*frame)[compressedIndex] = v.getAvg(c.SenseThreshold)
+					threshold := c.learn(compressedIndex, &mV[idx], c.blockThreshold(compressedIndex))
+					(*frame)[compressedIndex] = v.getAvg(threshold, c.sadScale, &c.SAD)
 				}
 				mV[idx].reset()
 				compressedIndex++
 			}
 		}
 	}
+
+	c.filterZones(frame)
 }
 
 func (c *Motion) getMaxBlockWidth() {
@@ -216,6 +222,26 @@ func (c *Motion) Init(usePreviousMask bool) {
 	if usePreviousMask {
 		c.ApplyPreviousMask()
 	}
+
+	c.lastNotify = make(map[string]time.Time)
+	c.loadZones()
+	cols, rows := c.GridSize()
+	c.Tripwires.load(c.RecordingFolder+"tripwires.json", cols, rows)
+	c.initAdaptive()
+	c.Heatmap.init(c.RecordingFolder+"heatmap/", cols, rows)
+
+	c.Filter.init()
+	if c.Tracker.MaxDistance == 0 {
+		c.Tracker.MaxDistance = 3
+	}
+	if c.Tracker.MaxMissed == 0 {
+		c.Tracker.MaxMissed = 3
+	}
+	if c.Tracker.MinSize < c.Filter.MinObjectSize {
+		c.Tracker.MinSize = c.Filter.MinObjectSize
+	}
+	log.Printf("Motion filters: object size >= %d, %d of %d frames, area <= %.2f\n",
+		c.Filter.MinObjectSize, c.Filter.PersistFrames, c.Filter.PersistWindow, c.Filter.MaxArea)
 }
 
 func (c *Motion) publishParsedBlocks(caster *broker.Broker, frame *[]motionVector) int {
@@ -300,10 +326,12 @@ func (c *Motion) Detect(caster *broker.Broker) {
 	c.highlightDistY = c.colCount
 
 	ignoredFrames := 0
+	c.sadBaseline.init(c.KeyframeInterval)
 
 	buf := make([]byte, 1024)
 	s := bufio.NewReader(conn)
 	blocksRead := 0
+	frameSAD := 0.0
 	for {
 		_, err := s.Read(buf)
 
@@ -318,9 +346,9 @@ func (c *Motion) Detect(caster *broker.Broker) {
 			temp := motionVector{}
 			temp.X = int8(buf[0+bufIdx])
 			temp.Y = int8(buf[1+bufIdx])
-			//temp.SAD = int16(buf[2+bufIdx]) << 4 // SAD might be spiking around keyframes and triggers false positives
-			//temp.SAD |= int16(buf[3+bufIdx])
+			temp.SAD = uint16(buf[2+bufIdx]) | uint16(buf[3+bufIdx])<<8
 			currMacroBlocks = append(currMacroBlocks, temp)
+			frameSAD += float64(temp.SAD)
 			bufIdx += sizeofMotionVector
 			blocksRead++
 
@@ -328,10 +356,41 @@ func (c *Motion) Detect(caster *broker.Broker) {
 				blocksRead = 0
 				if ignoredFrames < ignoreFirstFrames {
 					ignoredFrames++
+					frameSAD = 0
 					continue
 				}
+				meanSAD := frameSAD / float64(numMacroblocks)
+				frameSAD = 0
+				sadRatio := 0.0
+				c.sadScale = 0
+				if atomic.SwapUint32(&c.keyframeSeen, 0) == 1 {
+					c.sadBaseline.keyframe()
+				}
+				if expected := c.sadBaseline.expected(); expected > 0 {
+					sadRatio = meanSAD / expected
+					c.sadScale = 1 / expected
+				}
+
 				c.condenseBlocksDirection(&currCondensedBlocks, &currMacroBlocks)
-				if c.publishParsedBlocks(caster, &currCondensedBlocks) > 0 {
+				c.saveAdaptive()
+				atomic.AddUint64(&c.metrics.Frames, 1)
+				suppressed, sadSpike := c.illuminationChanged(&currCondensedBlocks, sadRatio)
+				c.sadBaseline.update(meanSAD, sadSpike)
+
+				var blobs []blob
+				if !suppressed {
+					blobs = c.blobs.find(&currCondensedBlocks, c.mColCount)
+					c.Heatmap.add(&currCondensedBlocks)
+				}
+				c.recordTracks(c.Tracker.update(blobs, time.Now(), c.mColCount, len(currCondensedBlocks)/c.mColCount))
+				passed := !suppressed && c.passesFilters(&currCondensedBlocks, blobs)
+				tripped := !suppressed && c.crossTripwires(passed)
+				c.Tripwires.saveCounts()
+				if c.publishParsedBlocks(caster, &currCondensedBlocks) > 0 && !suppressed {
+					c.notifyZones()
+				}
+				if passed && (tripped || c.triggersRecording(&currCondensedBlocks) && c.Tracker.matchesRules()) {
+					atomic.AddUint64(&c.metrics.TriggeredFrames, 1)
 					c.checkHighlight(&currCondensedBlocks)
 					if time.Now().After(c.recorder.StopTime) {
 						// reset highlight distance
@@ -339,9 +398,9 @@ func (c *Motion) Detect(caster *broker.Broker) {
 						c.highlightDistY = c.colCount
 					}
 					if c.triggeredOnlyNonEdge(&currCondensedBlocks) {
-						c.recorder.StopTime = time.Now().Add(time.Second * 10)
+						c.recorder.StopTime = time.Now().Add(c.recorder.PostRoll)
 					} else {
-						c.recorder.StopTime = time.Now().Add(time.Second * 5)
+						c.recorder.StopTime = time.Now().Add(c.recorder.PostRoll / 2)
 					}
 				}
 
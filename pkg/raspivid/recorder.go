@@ -5,14 +5,9 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"sentry-picam/broker"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
-
-	"github.com/ricochet2200/go-disk-usage/du"
 )
 
 // Recorder writes the video stream to disk
@@ -22,7 +17,32 @@ type Recorder struct {
 	HighlightTime   time.Time
 	hasFfmpeg       bool
 	MinFreeSpace    uint64
+	Archive         string        // second storage tier with the trailing slash, empty for none
+	ArchiveKeepFree uint64        // free space kept on Archive by deleting its oldest recordings, 0 for no limit
+	PreRoll         time.Duration // minimum video kept from before the trigger
+	PostRoll        time.Duration // video kept after motion stops
+	MaxClipLength   time.Duration // long events are split into files of this length, 0 disables
+	SegmentLength   time.Duration // length of continuously recorded segments
 	IsFreeingSpace  sync.Mutex
+	Schedule        Schedule
+	Locks           Locks
+	Retention       Retention
+	Offload         *Offload // uploads finished recordings when set
+	Integrity       Integrity
+	Thumbnails      Thumbnails // extra images made for each clip
+	Queue           ConversionQueue
+
+	rotation        rotationStatus
+	archiveRotation rotationStatus
+
+	eventLock sync.Mutex
+	event     EventInfo
+	tracker   *Tracker
+}
+
+// IsArmed reports if motion events should be recorded right now
+func (rec *Recorder) IsArmed() bool {
+	return rec.Schedule.IsArmed(time.Now(), rec.RequestedRecord)
 }
 
 func getFilename(lastName string) string {
@@ -36,70 +56,65 @@ func getFilename(lastName string) string {
 	return fmt.Sprintf(fileFormat+"_%02d", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second())
 }
 
-func (rec *Recorder) checkFfmpeg() bool {
+// CheckFfmpeg looks for ffmpeg, which recordings are converted with. Call it before
+// starting to record.
+func (rec *Recorder) CheckFfmpeg() bool {
 	_, err := exec.LookPath("ffmpeg")
 	if err == nil {
 		rec.hasFfmpeg = true
 	} else {
-		log.Println("ffmpeg not found - no thumbnails will be created")
+		log.Println("ffmpeg not found - recordings will be kept as raw H.264 with keyframe thumbnails")
 	}
 
 	return rec.hasFfmpeg
 }
 
-func (rec *Recorder) Maintenance(folder string) {
-	rec.IsFreeingSpace.Lock()
-	defer rec.IsFreeingSpace.Unlock()
-	usage := du.NewDiskUsage(folder)
-	freeSpace := usage.Available()
+// gopStart marks where a group of pictures, starting with an SPS header, begins in the buffer
+type gopStart struct {
+	index int
+	t     time.Time
+}
 
-	if freeSpace > rec.MinFreeSpace {
-		return
-	}
+// finishFile closes a recording, saves its event metadata, and queues it for conversion.
+// next names the following part when a long event is split, and is empty otherwise.
+func (rec *Recorder) finishFile(f *os.File, folderpath string, fileName string, startTime time.Time,
+	part int, previous string, next string) {
+	f.Close()
 
-	for freeSpace < rec.MinFreeSpace {
-		rec.deleteOldest(folder, freeSpace)
-		usage = du.NewDiskUsage(folder)
-		freeSpace = usage.Available()
+	var event EventInfo
+	if next == "" {
+		event = rec.takeEvent()
+	} else {
+		event = rec.takePart(fileName)
 	}
-}
-
-func (rec *Recorder) deleteOldest(folder string, freeSpace uint64) {
-	folders, err := os.ReadDir(folder)
-	if err != nil {
-		return
+	if event.Event == "" {
+		event.Event = fileName
+	}
+	event.Name = fileName
+	event.ClipStart = startTime
+	event.End = time.Now()
+	event.Part = part
+	event.Previous = previous
+	event.Next = next
+	if rec.tracker != nil {
+		event.Tracks = append(event.Tracks, rec.tracker.activeTracks()...)
+	}
+	if err := WriteEvent(folderpath+"raw/"+fileName+".json", event); err != nil {
+		log.Println(err)
 	}
 
-	for _, f := range folders {
-		if f.IsDir() {
-			files, err := os.ReadDir(folder + f.Name())
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			if len(files) == 0 {
-				os.Remove(folder + f.Name())
-				return
-			}
-
-			for _, v := range files {
-				extension := filepath.Ext(strings.ToLower(v.Name()))
-				name := strings.TrimSuffix(filepath.Base(v.Name()), filepath.Ext(v.Name()))
-
-				if extension == ".mp4" {
-					os.Remove(folder + f.Name() + "/" + name + ".mp4")
-					os.Remove(folder + f.Name() + "/" + name + ".jpg")
-					log.Println("Low free space (" + strconv.FormatUint(freeSpace/1024, 10) + " KiB free). Deleted oldest recording: " + name)
-					return
-				}
-			}
-		}
+	highlight := rec.HighlightTime.Sub(startTime).Seconds() - .25
+	if highlight < 0 || highlight > event.End.Sub(startTime).Seconds() {
+		highlight = 3 // highlight happened in another part
 	}
+	rec.Queue.Enqueue(fileName, highlight, PriorityEvent)
+	rec.Queue.requestMaintenance()
 }
 
 // Init initializes the raspivid recorder. folderpath must include the trailing slash
-// When recording is triggered by (rec.StopTime > now), up to numHeaders Iframes will be
-// saved before the trigger
+// When recording is triggered by (rec.StopTime > now), at least PreRoll of video, starting
+// from a keyframe, will be saved before the trigger. Events longer than MaxClipLength are
+// split into consecutive files at the next keyframe.
 func (rec *Recorder) Init(caster *broker.Broker, folderpath string, framerate int, triggerScript string) {
 	os.MkdirAll(folderpath+"raw/", 0700)
 
@@ -107,33 +122,66 @@ func (rec *Recorder) Init(caster *broker.Broker, folderpath string, framerate in
 	converter.Framerate = framerate
 	converter.TriggerScript = triggerScript
 	converter.Init(rec, folderpath)
-	if rec.checkFfmpeg() {
-		go converter.convertFolder(folderpath)
-	}
+	rec.Queue.load(&converter, folderpath)
+	leftovers := rawLeftovers(folderpath + "raw/")
+	rec.Integrity.start()
+	go func() {
+		rec.Integrity.checkRaw(folderpath, folderpath+"raw/", leftovers)
+		rec.Integrity.checkStored(rec, folderpath, folderpath, framerate)
+		rec.Integrity.checkStored(rec, folderpath, folderpath+ContinuousFolder, 0)
+		// conversions start after the check, so it doesn't see half converted recordings
+		rec.Queue.enqueueLeftovers(leftovers)
+		rec.Queue.start(rec)
+		rec.Integrity.finish()
+	}()
+	go rec.maintainPeriodically(folderpath)
 
 	extension := ".h264"
 	stream := caster.Subscribe()
 	defer caster.Unsubscribe(stream)
-	numHeaders := 0
 
 	var f *os.File
 	var fileName string
+	var previousPart string
 	var startTime time.Time
+	part := 0
 
 	buf := [][]byte{}
-	i := 0
-	frameOffset := 0
+	gops := []gopStart{}
 	startedFile := false
 	for {
 		x := <-stream
+		packet := x.([]byte)
+		now := time.Now()
+		isSPS := packet[4] == 39
+
+		if rec.IsArmed() || startedFile {
+			if rec.IsArmed() && now.Before(rec.StopTime) {
+				if startedFile && isSPS && rec.MaxClipLength > 0 && now.Sub(startTime) >= rec.MaxClipLength {
+					next := getFilename(fileName)
+					for _, v := range buf {
+						f.Write(v)
+					}
+					buf = buf[:0]
+					gops = gops[:0]
+					rec.finishFile(f, folderpath, fileName, startTime, part, previousPart, next)
+
+					previousPart = fileName
+					fileName = next
+					f, _ = os.Create(folderpath + "raw/" + fileName + extension)
+					startTime = now
+					part++
+				}
 
-		if rec.RequestedRecord {
-			if time.Now().Before(rec.StopTime) {
 				if !startedFile {
 					fileName = getFilename(fileName)
 					f, _ = os.Create(folderpath + "raw/" + fileName + extension)
-					startTime = time.Now()
-					frameOffset = i
+					startTime = now
+					if len(gops) > 0 {
+						startTime = gops[0].t
+					}
+					previousPart = ""
+					part = 1
 				}
 
 				startedFile = true
@@ -145,31 +193,27 @@ func (rec *Recorder) Init(caster *broker.Broker, folderpath string, framerate in
 					}
 				}
 				buf = buf[:0]
-				numHeaders = 0
-				i = 0
+				gops = gops[:0]
 			} else if startedFile {
-				f.Close()
-				go func(highlightTime time.Time, startTime time.Time, frameOffset int) {
-					converter.CacheItem(fileName, highlightTime.Sub(startTime).Seconds()+float64(frameOffset)/float64(framerate)-.25)
-					converter.convertFile(fileName)
-				}(rec.HighlightTime, startTime, frameOffset)
-
-				go rec.Maintenance(folderpath)
-
+				rec.finishFile(f, folderpath, fileName, startTime, part, previousPart, "")
 				startedFile = false
 			}
 		}
 
-		if x.([]byte)[4] == 39 { // always start with SPS header
-			if numHeaders == 2 {
-				buf = buf[i:]
-				numHeaders = 0
-				i = 0
+		if isSPS { // always start with SPS header
+			gops = append(gops, gopStart{len(buf), now})
+
+			// drop the oldest group of pictures while the rest still covers the pre-roll
+			for len(gops) > 1 && now.Sub(gops[1].t) >= rec.PreRoll {
+				drop := gops[1].index
+				buf = buf[drop:]
+				gops = gops[1:]
+				for j := range gops {
+					gops[j].index -= drop
+				}
 			}
-			numHeaders++
 		}
 
-		buf = append(buf, x.([]byte))
-		i++
+		buf = append(buf, packet)
 	}
 }
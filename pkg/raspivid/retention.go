@@ -0,0 +1,322 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const retentionInterval = time.Hour
+
+// Recording kinds
+const (
+	KindEvent       = "event"
+	KindContinuous  = "continuous"
+	KindTrash       = "trash"
+	KindQuarantined = "quarantined" // failed the integrity check
+	KindOrphan      = "orphan"      // thumbnail or metadata left without its video
+)
+
+// RetentionRule limits which recordings are kept. Zero values don't limit.
+type RetentionRule struct {
+	MaxAgeDays int    `json:"maxAgeDays"`
+	MaxBytes   uint64 `json:"maxBytes"`
+	MaxPerDay  int    `json:"maxPerDay"` // the newest recordings of each day are kept
+}
+
+// RetentionPolicy applies a rule to each kind of recording. Locked recordings only follow
+// the Locked rule, which keeps them forever by default.
+type RetentionPolicy struct {
+	Events     RetentionRule `json:"events"`
+	Continuous RetentionRule `json:"continuous"`
+	Locked     RetentionRule `json:"locked"`
+}
+
+// RetentionDeletion is a recording deleted, or that would be deleted, by the retention policy
+type RetentionDeletion struct {
+	Name   string    `json:"name"`
+	Kind   string    `json:"kind"`
+	Time   time.Time `json:"time"`
+	Bytes  uint64    `json:"bytes"`
+	Reason string    `json:"reason"`
+}
+
+// Retention stores the retention policy
+type Retention struct {
+	policy RetentionPolicy
+	file   string
+	lock   sync.Mutex
+}
+
+// storedRecording is an event recording or continuous segment on disk
+type storedRecording struct {
+	Name   string
+	Dir    string
+	Kind   string
+	Time   time.Time
+	Bytes  uint64
+	Locked bool
+}
+
+func (r *RetentionRule) validate() error {
+	if r.MaxAgeDays < 0 || r.MaxPerDay < 0 {
+		return errors.New("retention limits can't be negative")
+	}
+	return nil
+}
+
+// Get returns the retention policy
+func (rt *Retention) Get() RetentionPolicy {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	return rt.policy
+}
+
+// Set validates and applies a retention policy, then saves it to disk
+func (rt *Retention) Set(p RetentionPolicy) error {
+	for _, r := range []RetentionRule{p.Events, p.Continuous, p.Locked} {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.policy = p
+	if rt.file == "" {
+		return nil
+	}
+	out, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(rt.file, out, 0600)
+}
+
+// Load reads a previously saved retention policy. Later changes are saved to the same file.
+func (rt *Retention) Load(file string) {
+	rt.lock.Lock()
+	rt.file = file
+	rt.lock.Unlock()
+
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	p := RetentionPolicy{}
+	if err := json.Unmarshal(f, &p); err != nil {
+		log.Println("Couldn't load retention policy: " + err.Error())
+		return
+	}
+	rt.lock.Lock()
+	rt.policy = p
+	rt.lock.Unlock()
+}
+
+// evaluate returns the recordings the rule doesn't keep, given recordings sorted oldest first
+func (r *RetentionRule) evaluate(recordings []storedRecording, now time.Time) []RetentionDeletion {
+	deleted := make([]string, len(recordings)) // reason, if deleted
+	if r.MaxAgeDays > 0 {
+		cutoff := now.AddDate(0, 0, -r.MaxAgeDays)
+		for i, v := range recordings {
+			if v.Time.Before(cutoff) {
+				deleted[i] = fmt.Sprintf("older than %d days", r.MaxAgeDays)
+			}
+		}
+	}
+
+	perDay := make(map[string]int)
+	var total uint64
+	for i := len(recordings) - 1; i >= 0; i-- {
+		if deleted[i] != "" {
+			continue
+		}
+		v := recordings[i]
+		day := v.Time.Format("2006-01-02")
+		if r.MaxPerDay > 0 && perDay[day] >= r.MaxPerDay {
+			deleted[i] = fmt.Sprintf("more than %d on %s", r.MaxPerDay, day)
+			continue
+		}
+		if r.MaxBytes > 0 && total+v.Bytes > r.MaxBytes {
+			deleted[i] = fmt.Sprintf("over %d bytes in total", r.MaxBytes)
+			continue
+		}
+		perDay[day]++
+		total += v.Bytes
+	}
+
+	deletions := []RetentionDeletion{}
+	for i, v := range recordings {
+		if deleted[i] != "" {
+			deletions = append(deletions, RetentionDeletion{v.Name, v.Kind, v.Time, v.Bytes, deleted[i]})
+		}
+	}
+	return deletions
+}
+
+// evaluate returns the recordings the policy doesn't keep, given recordings sorted oldest first
+func (p *RetentionPolicy) evaluate(recordings []storedRecording, now time.Time) []RetentionDeletion {
+	var events, continuous, locked []storedRecording
+	for _, v := range recordings {
+		switch {
+		case v.Locked:
+			locked = append(locked, v)
+		case v.Kind == KindContinuous:
+			continuous = append(continuous, v)
+		default:
+			events = append(events, v)
+		}
+	}
+
+	deletions := p.Events.evaluate(events, now)
+	deletions = append(deletions, p.Continuous.evaluate(continuous, now)...)
+	deletions = append(deletions, p.Locked.evaluate(locked, now)...)
+	sort.Slice(deletions, func(i, j int) bool { return deletions[i].Time.Before(deletions[j].Time) })
+	return deletions
+}
+
+// scanFolder lists the recordings in dir, and the leftover files of recordings whose
+// video is gone
+func (rec *Recorder) scanFolder(dir string, kind string) ([]storedRecording, []storedRecording) {
+	recordings := []storedRecording{}
+	orphans := []storedRecording{}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println(err)
+		return recordings, orphans
+	}
+
+	sizes := make(map[string]uint64)
+	hasVideo := make(map[string]bool)
+	for _, v := range files {
+		if v.IsDir() {
+			continue
+		}
+		extension := filepath.Ext(strings.ToLower(v.Name()))
+		name := recordingName(v.Name())
+		if info, err := v.Info(); err == nil {
+			sizes[name] += uint64(info.Size())
+		}
+		if extension == ".mp4" || extension == ".h264" {
+			hasVideo[name] = true
+		}
+	}
+
+	for name, size := range sizes {
+		t, err := parseRecordingName(name)
+		if err != nil {
+			continue // not a recording
+		}
+		r := storedRecording{name, dir, kind, t, size, rec.Locks.IsLocked(name)}
+		if hasVideo[name] {
+			recordings = append(recordings, r)
+		} else {
+			r.Kind = KindOrphan
+			orphans = append(orphans, r)
+		}
+	}
+	return recordings, orphans
+}
+
+// scanRecordings lists the recordings and leftover files in the dated subfolders of dir
+func (rec *Recorder) scanRecordings(dir string, kind string) ([]storedRecording, []storedRecording) {
+	recordings := []storedRecording{}
+	orphans := []storedRecording{}
+	folders, err := os.ReadDir(dir)
+	if err != nil {
+		return recordings, orphans
+	}
+
+	for _, f := range folders {
+		if !f.IsDir() || f.Name()[0] < '0' || f.Name()[0] > '9' {
+			continue
+		}
+		r, o := rec.scanFolder(dir+f.Name()+"/", kind)
+		recordings = append(recordings, r...)
+		orphans = append(orphans, o...)
+	}
+	return recordings, orphans
+}
+
+// listRecordings returns the event recordings and continuous segments sorted oldest first
+func (rec *Recorder) listRecordings(folder string) []storedRecording {
+	recordings, _ := rec.scanRecordings(folder, KindEvent)
+	segments, _ := rec.scanRecordings(folder+ContinuousFolder, KindContinuous)
+	recordings = append(recordings, segments...)
+	sortByTime(recordings)
+	return recordings
+}
+
+func sortByTime(recordings []storedRecording) {
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Time.Before(recordings[j].Time) })
+}
+
+// deleteRecording removes the files of a recording
+func deleteRecording(r storedRecording) error {
+	var failed error
+	for _, ext := range recordingExtensions {
+		if err := os.Remove(r.Dir + r.Name + ext); err != nil && !os.IsNotExist(err) {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// listAllTiers returns the recordings in folder and the archive sorted oldest first, so
+// retention limits apply to both tiers together
+func (rec *Recorder) listAllTiers(folder string) []storedRecording {
+	recordings := rec.listRecordings(folder)
+	if rec.Archive != "" {
+		recordings = append(recordings, rec.listRecordings(rec.Archive)...)
+		sortByTime(recordings)
+	}
+	return recordings
+}
+
+// PreviewRetention returns the recordings the retention policy would delete now
+func (rec *Recorder) PreviewRetention(folder string) []RetentionDeletion {
+	p := rec.Retention.Get()
+	return p.evaluate(rec.listAllTiers(folder), time.Now())
+}
+
+// applyRetention deletes the recordings the retention policy doesn't keep
+func (rec *Recorder) applyRetention(folder string) {
+	p := rec.Retention.Get()
+	recordings := rec.listAllTiers(folder)
+	byName := make(map[string]storedRecording)
+	for _, r := range recordings {
+		byName[r.Kind+r.Name] = r
+	}
+
+	for _, d := range p.evaluate(recordings, time.Now()) {
+		r := byName[d.Kind+d.Name]
+		if err := deleteRecording(r); err != nil {
+			log.Println("Couldn't delete " + d.Name + ": " + err.Error())
+			continue
+		}
+		if r.Locked {
+			// so it isn't listed as locked, or blamed for low free space, after it's gone
+			if err := rec.Locks.Unlock(r.Name); err != nil {
+				log.Println("Couldn't unlock " + d.Name + ": " + err.Error())
+			}
+		}
+		log.Println("Deleted " + d.Kind + " recording " + d.Name + ", " + d.Reason)
+	}
+}
+
+// maintainPeriodically applies the retention policy and frees space on a schedule, in
+// addition to after each recording
+func (rec *Recorder) maintainPeriodically(folder string) {
+	for {
+		time.Sleep(retentionInterval)
+		rec.Maintenance(folder)
+	}
+}
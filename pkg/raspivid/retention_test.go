@@ -0,0 +1,106 @@
+package raspivid
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionEvaluate(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)
+	stored := func(name string, kind string, bytes uint64, locked bool) storedRecording {
+		tm, err := parseRecordingName(name)
+		if err != nil {
+			panic(err)
+		}
+		return storedRecording{name, "", kind, tm, bytes, locked}
+	}
+	recordings := []storedRecording{
+		stored("2024-01-01-0900", KindEvent, 100, false),
+		stored("2024-01-01-1000", KindEvent, 100, true),
+		stored("2024-01-08-0900", KindContinuous, 100, false),
+		stored("2024-01-09-0900", KindEvent, 100, false),
+		stored("2024-01-09-1000", KindEvent, 100, false),
+		stored("2024-01-09-1100", KindEvent, 100, false),
+		stored("2024-01-10-0900", KindEvent, 100, false),
+	}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		want   []string
+	}{
+		{"no limits", RetentionPolicy{}, []string{}},
+		{"max age", RetentionPolicy{Events: RetentionRule{MaxAgeDays: 3}},
+			[]string{"2024-01-01-0900"}},
+		{"max per day", RetentionPolicy{Events: RetentionRule{MaxPerDay: 2}},
+			[]string{"2024-01-09-0900"}},
+		{"max bytes", RetentionPolicy{Events: RetentionRule{MaxBytes: 250}},
+			[]string{"2024-01-01-0900", "2024-01-09-0900", "2024-01-09-1000"}},
+		{"old recordings don't count towards size", RetentionPolicy{Events: RetentionRule{MaxAgeDays: 3, MaxBytes: 350}},
+			[]string{"2024-01-01-0900", "2024-01-09-0900"}},
+		{"continuous", RetentionPolicy{Continuous: RetentionRule{MaxAgeDays: 1}},
+			[]string{"2024-01-08-0900"}},
+		{"locked", RetentionPolicy{Locked: RetentionRule{MaxAgeDays: 3}},
+			[]string{"2024-01-01-1000"}},
+		{"locked exempt", RetentionPolicy{
+			Events:     RetentionRule{MaxAgeDays: 1, MaxPerDay: 1, MaxBytes: 1},
+			Continuous: RetentionRule{MaxAgeDays: 1},
+		}, []string{"2024-01-01-0900", "2024-01-08-0900", "2024-01-09-0900", "2024-01-09-1000", "2024-01-09-1100",
+			"2024-01-10-0900"}},
+	}
+	for _, test := range tests {
+		got := []string{}
+		for _, d := range test.policy.evaluate(recordings, now) {
+			got = append(got, d.Name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: deleted %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRetentionUnlocksDeleted(t *testing.T) {
+	folder := t.TempDir() + "/"
+	dir := folder + "2024-01/"
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"2024-01-01-0900", "2024-01-01-1000"} {
+		if err := os.WriteFile(dir+name+".mp4", []byte("video"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := &Recorder{}
+	rec.Locks.Load(folder)
+	if err := rec.Locks.Lock("2024-01-01-0900"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Locks.Lock("2024-01-01-1000"); err != nil {
+		t.Fatal(err)
+	}
+	// only the newest locked recording of the day is kept
+	if err := rec.Retention.Set(RetentionPolicy{Locked: RetentionRule{MaxPerDay: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	rec.applyRetention(folder)
+
+	if _, err := os.Stat(dir + "2024-01-01-0900.mp4"); !os.IsNotExist(err) {
+		t.Error("older locked recording wasn't deleted")
+	}
+	if _, err := os.Stat(dir + "2024-01-01-1000.mp4"); err != nil {
+		t.Error("newest locked recording was deleted")
+	}
+	if got := rec.Locks.State().Locked; !reflect.DeepEqual(got, []string{"2024-01-01-1000"}) {
+		t.Errorf("locked recordings are %v after deleting, want only the one kept", got)
+	}
+
+	// a reload reads the same from disk
+	reloaded := Locks{}
+	reloaded.Load(folder)
+	if reloaded.IsLocked("2024-01-01-0900") || !reloaded.IsLocked("2024-01-01-1000") {
+		t.Errorf("saved locks are %v", reloaded.State().Locked)
+	}
+}
@@ -0,0 +1,208 @@
+package raspivid
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ricochet2200/go-disk-usage/du"
+)
+
+// rotation passes re-check free space, in case deleted files took less space than their size
+const maxRotationPasses = 3
+
+// RotationResult reports the latest time recordings were deleted to free space
+type RotationResult struct {
+	Time       time.Time `json:"time"`
+	FreeBefore uint64    `json:"freeBefore"`
+	FreeAfter  uint64    `json:"freeAfter"`
+	Deleted    []string  `json:"deleted"`
+	Failed     []string  `json:"failed"`
+	Warning    string    `json:"warning"` // set if MinFreeSpace couldn't be reached
+}
+
+// rotationStatus guards the latest rotation result
+type rotationStatus struct {
+	last *RotationResult
+	lock sync.Mutex
+}
+
+// get returns the latest result, or nil if none happened yet
+func (rs *rotationStatus) get() *RotationResult {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	if rs.last == nil {
+		return nil
+	}
+	r := *rs.last
+	return &r
+}
+
+// LastRotation returns the result of the latest rotation, or nil if none happened yet
+func (rec *Recorder) LastRotation() *RotationResult {
+	return rec.rotation.get()
+}
+
+// LastArchiveRotation returns the result of the latest rotation on the archive, or nil if
+// none happened yet
+func (rec *Recorder) LastArchiveRotation() *RotationResult {
+	return rec.archiveRotation.get()
+}
+
+// rotationCandidates lists what may be deleted to free space, in the order it should go:
+// leftover files, then quarantined and discarded recordings, then unlocked recordings
+// oldest first. Leftovers written in the last minute may belong to a recording still
+// being converted.
+func (rec *Recorder) rotationCandidates(folder string) []storedRecording {
+	events, orphans := rec.scanRecordings(folder, KindEvent)
+	segments, segmentOrphans := rec.scanRecordings(folder+ContinuousFolder, KindContinuous)
+	var trash, trashOrphans []storedRecording
+	if _, err := os.Stat(folder + TrashFolder); err == nil {
+		trash, trashOrphans = rec.scanFolder(folder+TrashFolder, KindTrash)
+	}
+	var quarantined, quarantinedOrphans []storedRecording
+	if _, err := os.Stat(folder + QuarantineFolder); err == nil {
+		quarantined, quarantinedOrphans = rec.scanFolder(folder+QuarantineFolder, KindQuarantined)
+		quarantined = append(quarantined, quarantinedOrphans...)
+		sortByTime(quarantined)
+	}
+
+	recordings := append(events, segments...)
+	sortByTime(recordings)
+	var candidates []storedRecording
+	for _, r := range append(append(orphans, segmentOrphans...), trashOrphans...) {
+		if !recentlyWritten(r) {
+			candidates = append(candidates, r)
+		}
+	}
+	candidates = append(candidates, quarantined...)
+	candidates = append(candidates, trash...)
+	for _, r := range recordings {
+		if !r.Locked {
+			candidates = append(candidates, r)
+		}
+	}
+	return candidates
+}
+
+// removeEmptyFolders removes the dated subfolders of dir that have nothing left in them
+func removeEmptyFolders(dir string) {
+	folders, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range folders {
+		if !f.IsDir() || f.Name()[0] < '0' || f.Name()[0] > '9' {
+			continue
+		}
+		if files, err := os.ReadDir(dir + f.Name()); err == nil && len(files) == 0 {
+			os.Remove(dir + f.Name())
+		}
+	}
+}
+
+// rotate deletes the oldest recordings in folder until minFree is available. It returns
+// false if there was already enough free space.
+func (rec *Recorder) rotate(folder string, minFree uint64) (RotationResult, bool) {
+	freeSpace := du.NewDiskUsage(folder).Available()
+	if freeSpace >= minFree {
+		return RotationResult{}, false
+	}
+
+	result := RotationResult{Time: time.Now(), FreeBefore: freeSpace, Deleted: []string{}, Failed: []string{}}
+	failed := make(map[string]bool) // not retried in later passes
+	for pass := 0; pass < maxRotationPasses && freeSpace < minFree; pass++ {
+		need := minFree - freeSpace
+		var freed uint64
+		deleted := 0
+		for _, c := range rec.rotationCandidates(folder) {
+			if freed >= need {
+				break
+			}
+			if failed[c.Dir+c.Name] {
+				continue
+			}
+			if err := deleteRecording(c); err != nil {
+				failed[c.Dir+c.Name] = true
+				result.Failed = append(result.Failed, c.Name+": "+err.Error())
+				continue
+			}
+			freed += c.Bytes
+			deleted++
+			result.Deleted = append(result.Deleted, c.Name)
+		}
+
+		freeSpace = du.NewDiskUsage(folder).Available()
+		if deleted == 0 {
+			break
+		}
+	}
+	removeEmptyFolders(folder)
+	removeEmptyFolders(folder + ContinuousFolder)
+	result.FreeAfter = freeSpace
+
+	log.Printf("Low free space in %s (%d KiB free). Deleted %d recordings, %d KiB free now\n",
+		folder, result.FreeBefore/1024, len(result.Deleted), result.FreeAfter/1024)
+	for _, f := range result.Failed {
+		log.Println("Couldn't delete " + f)
+	}
+	return result, true
+}
+
+// Maintenance applies the retention policy, then deletes the oldest recordings until
+// MinFreeSpace is available
+func (rec *Recorder) Maintenance(folder string) {
+	rec.IsFreeingSpace.Lock()
+	defer rec.IsFreeingSpace.Unlock()
+	rec.applyRetention(folder)
+
+	result, rotated := rec.rotate(folder, rec.MinFreeSpace)
+	if !rotated {
+		rec.Locks.warn("")
+		return
+	}
+
+	if result.FreeAfter < rec.MinFreeSpace {
+		if len(rec.Locks.State().Locked) > 0 {
+			result.Warning = "Locked recordings are preventing " + strconv.FormatUint(rec.MinFreeSpace/1024, 10) +
+				" KiB of free space from being kept (" + strconv.FormatUint(result.FreeAfter/1024, 10) + " KiB free)"
+			rec.Locks.warn(result.Warning)
+		} else {
+			result.Warning = fmt.Sprintf("Couldn't free %d KiB, only %d KiB free", rec.MinFreeSpace/1024, result.FreeAfter/1024)
+			log.Println(result.Warning)
+		}
+	} else {
+		rec.Locks.warn("")
+	}
+
+	rec.rotation.lock.Lock()
+	rec.rotation.last = &result
+	rec.rotation.lock.Unlock()
+}
+
+// maintainArchive deletes the oldest recordings on the archive until ArchiveKeepFree is
+// available there
+func (rec *Recorder) maintainArchive() {
+	if rec.Archive == "" || rec.ArchiveKeepFree == 0 {
+		return
+	}
+	rec.IsFreeingSpace.Lock()
+	defer rec.IsFreeingSpace.Unlock()
+
+	result, rotated := rec.rotate(rec.Archive, rec.ArchiveKeepFree)
+	if !rotated {
+		return
+	}
+	if result.FreeAfter < rec.ArchiveKeepFree {
+		result.Warning = fmt.Sprintf("Couldn't free %d KiB on the archive, only %d KiB free", rec.ArchiveKeepFree/1024, result.FreeAfter/1024)
+		log.Println(result.Warning)
+	}
+
+	rec.archiveRotation.lock.Lock()
+	rec.archiveRotation.last = &result
+	rec.archiveRotation.lock.Unlock()
+}
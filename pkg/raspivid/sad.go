@@ -0,0 +1,134 @@
+package raspivid
+
+import (
+	"fmt"
+	"sentry-picam/broker"
+	"sync/atomic"
+)
+
+const sadAverageWeight = .05 // weight of the newest frame in the running SAD average
+
+// SAD criterion modes
+const (
+	SADOff   = "off"   // direction of motion vectors only
+	SADAnd   = "and"   // direction and SAD must both trigger
+	SADOr    = "or"    // either direction or SAD may trigger
+	SADScore = "score" // average of the direction and SAD scores must reach 1
+)
+
+// SADCriterion uses the Sum of Absolute Difference of each motion block as an additional
+// detection signal. SAD is normalized against the typical SAD of frames at the same position
+// in the keyframe interval, since it spikes around keyframes.
+type SADCriterion struct {
+	Mode      string
+	Threshold float64 // normalized SAD that triggers a block, e.g. 2 is twice the typical SAD
+}
+
+// Validate checks the mode and threshold
+func (s *SADCriterion) Validate() error {
+	switch s.Mode {
+	case "":
+		s.Mode = SADOff
+	case SADOff, SADAnd, SADOr, SADScore:
+	default:
+		return fmt.Errorf("invalid SAD mode %q", s.Mode)
+	}
+	if s.Mode != SADOff && s.Threshold <= 0 {
+		return fmt.Errorf("SAD threshold must be greater than 0")
+	}
+	return nil
+}
+
+// sadBaseline tracks the typical mean SAD of a frame at each position of the keyframe interval.
+// Positions are counted from the latest keyframe seen in the video stream.
+type sadBaseline struct {
+	phases []float64
+	frame  int
+	synced bool // a keyframe was seen since init
+}
+
+func (b *sadBaseline) init(keyframeInterval int) {
+	if keyframeInterval < 1 {
+		keyframeInterval = 1
+	}
+	b.phases = make([]float64, keyframeInterval)
+	b.frame = 0
+	b.synced = false
+}
+
+// keyframe makes the current frame the first of the keyframe interval. What was learned
+// before the first keyframe is discarded, since it was counted from an arbitrary frame.
+func (b *sadBaseline) keyframe() {
+	if !b.synced {
+		for i := range b.phases {
+			b.phases[i] = 0
+		}
+		b.synced = true
+	}
+	b.frame = 0
+}
+
+// expected returns the typical mean SAD for the current frame, 0 while still learning
+func (b *sadBaseline) expected() float64 {
+	return b.phases[b.frame%len(b.phases)]
+}
+
+// update adds the mean SAD of the current frame to the baseline and advances to the next frame.
+// Spikes are left out so a sudden change can't mask the next one.
+func (b *sadBaseline) update(mean float64, spike bool) {
+	i := b.frame % len(b.phases)
+	if b.phases[i] == 0 {
+		b.phases[i] = mean
+	} else if !spike {
+		b.phases[i] = b.phases[i]*(1-sadAverageWeight) + mean*sadAverageWeight
+	}
+	b.frame++
+}
+
+// WatchKeyframes follows the video stream so the SAD baseline stays aligned with its
+// keyframes, even if frames are dropped or the interval isn't what was asked for
+func (c *Motion) WatchKeyframes(caster *broker.Broker) {
+	stream := caster.Subscribe()
+	defer caster.Unsubscribe(stream)
+
+	for x := range stream {
+		if packet := x.([]byte); len(packet) > 4 && packet[4]&0x1f == nalSPS {
+			atomic.StoreUint32(&c.keyframeSeen, 1)
+		}
+	}
+}
+
+// directionScore is the fraction of threshold reached by the weaker of the X and Y directions
+func (mV *mVhelper) directionScore(threshold int8) float64 {
+	x := mV.tX
+	if mV.tXn > x {
+		x = mV.tXn
+	}
+	y := mV.tY
+	if mV.tYn > y {
+		y = mV.tYn
+	}
+	if y < x {
+		x = y
+	}
+	return float64(x) / float64(threshold)
+}
+
+// sadTriggered combines the direction test with the normalized SAD of the block.
+// sadScale converts raw SAD to normalized SAD, 0 while the baseline is unknown.
+func (mV *mVhelper) sadTriggered(direction bool, threshold int8, sadScale float64, crit *SADCriterion) bool {
+	if crit.Mode == SADOff || crit.Mode == "" || sadScale == 0 || mV.count == 0 {
+		return direction
+	}
+
+	sad := float64(mV.sad) / float64(mV.count) * sadScale
+	switch crit.Mode {
+	case SADAnd:
+		return direction && sad >= crit.Threshold
+	case SADOr:
+		return direction || sad >= crit.Threshold
+	case SADScore:
+		return (mV.directionScore(threshold)+sad/crit.Threshold)/2 >= 1
+	}
+	return direction
+}
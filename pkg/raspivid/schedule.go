@@ -0,0 +1,232 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleWindow arms recording between Start and End ("15:04", or "24:00" for midnight) on the listed days.
+// A window whose End is before its Start runs past midnight into the next day.
+type ScheduleWindow struct {
+	Days  []string `json:"days"` // "mon", "tue", ... An empty list means every day
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// HolidayOverride arms or disarms recording for an entire date ("2006-01-02")
+type HolidayOverride struct {
+	Date  string `json:"date"`
+	Armed bool   `json:"armed"`
+}
+
+// Schedule decides when the recorder is armed
+type Schedule struct {
+	Windows  []ScheduleWindow  `json:"windows"`
+	Holidays []HolidayOverride `json:"holidays"`
+
+	overrideArmed bool
+	overrideUntil time.Time
+	file          string
+	mu            sync.Mutex
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseClock(s string) (int, error) {
+	if s == "24:00" { // end of day
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *ScheduleWindow) hasDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *ScheduleWindow) validate() error {
+	for _, d := range w.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("invalid day %q", d)
+		}
+	}
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	_, err := parseClock(w.End)
+	return err
+}
+
+// contains reports if t falls within the window
+func (w *ScheduleWindow) contains(t time.Time) bool {
+	start, _ := parseClock(w.Start)
+	end, _ := parseClock(w.End)
+	now := t.Hour()*60 + t.Minute()
+
+	if start <= end {
+		return w.hasDay(t.Weekday()) && now >= start && now < end
+	}
+
+	// overnight window, e.g. 18:00 - 07:00
+	if now >= start {
+		return w.hasDay(t.Weekday())
+	}
+	return now < end && w.hasDay(t.AddDate(0, 0, -1).Weekday())
+}
+
+// Validate checks windows and holiday overrides for formatting errors
+func (s *Schedule) Validate() error {
+	for i := range s.Windows {
+		if err := s.Windows[i].validate(); err != nil {
+			return err
+		}
+	}
+	for _, h := range s.Holidays {
+		if _, err := time.Parse("2006-01-02", h.Date); err != nil {
+			return errors.New("invalid holiday date " + h.Date + ", expected YYYY-MM-DD")
+		}
+	}
+	return nil
+}
+
+// IsArmed reports if the schedule permits recording at time t.
+// requested is the manual record switch, which a temporary override supersedes.
+func (s *Schedule) IsArmed(t time.Time, requested bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.Before(s.overrideUntil) {
+		return s.overrideArmed
+	}
+	if !requested {
+		return false
+	}
+
+	date := t.Format("2006-01-02")
+	for _, h := range s.Holidays {
+		if h.Date == date {
+			return h.Armed
+		}
+	}
+
+	if len(s.Windows) == 0 {
+		return true
+	}
+	for i := range s.Windows {
+		if s.Windows[i].contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Override arms or disarms recording for duration d, regardless of the schedule.
+// A zero duration clears the override.
+func (s *Schedule) Override(armed bool, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.overrideArmed = armed
+	s.overrideUntil = time.Now().Add(d)
+}
+
+// GetOverride returns the active override, if any
+func (s *Schedule) GetOverride() (armed bool, until time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Now().Before(s.overrideUntil) {
+		return s.overrideArmed, s.overrideUntil, true
+	}
+	return false, time.Time{}, false
+}
+
+// Set replaces the windows and holidays of the schedule and saves it to disk
+func (s *Schedule) Set(windows []ScheduleWindow, holidays []HolidayOverride) error {
+	next := Schedule{Windows: windows, Holidays: holidays}
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.Windows = windows
+	s.Holidays = holidays
+	s.mu.Unlock()
+
+	return s.save()
+}
+
+// Get returns a copy of the windows and holidays
+func (s *Schedule) Get() ([]ScheduleWindow, []HolidayOverride) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	windows := append([]ScheduleWindow{}, s.Windows...)
+	holidays := append([]HolidayOverride{}, s.Holidays...)
+	return windows, holidays
+}
+
+func (s *Schedule) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	out, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.file, out, 0600)
+}
+
+// Load reads a previously saved schedule from file. Later changes are saved to the same file.
+func (s *Schedule) Load(file string) {
+	s.file = file
+
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+
+	loaded := Schedule{}
+	if err := json.Unmarshal(f, &loaded); err != nil {
+		log.Println("Couldn't load schedule: " + err.Error())
+		return
+	}
+	if err := loaded.Validate(); err != nil {
+		log.Println("Couldn't load schedule: " + err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.Windows = loaded.Windows
+	s.Holidays = loaded.Holidays
+	s.mu.Unlock()
+	log.Printf("Recording schedule loaded with %d windows\n", len(loaded.Windows))
+}
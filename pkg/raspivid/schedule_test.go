@@ -0,0 +1,125 @@
+package raspivid
+
+import (
+	"testing"
+	"time"
+)
+
+// weekTime returns a time on the week starting Monday 2024-01-01, with day 0 being Monday
+func weekTime(day int, clock string) time.Time {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2024, 1, 1+day, t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func TestScheduleWindows(t *testing.T) {
+	weekdayNights := ScheduleWindow{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "22:00", End: "06:00"}
+	tests := []struct {
+		name    string
+		windows []ScheduleWindow
+		t       time.Time
+		want    bool
+	}{
+		{"no windows", nil, weekTime(0, "12:00"), true},
+		{"inside", []ScheduleWindow{{Start: "08:00", End: "17:00"}}, weekTime(0, "08:00"), true},
+		{"end is exclusive", []ScheduleWindow{{Start: "08:00", End: "17:00"}}, weekTime(0, "17:00"), false},
+		{"before", []ScheduleWindow{{Start: "08:00", End: "17:00"}}, weekTime(0, "07:59"), false},
+		{"until midnight", []ScheduleWindow{{Start: "20:00", End: "24:00"}}, weekTime(0, "23:59"), true},
+		{"weekday", []ScheduleWindow{{Days: []string{"mon"}, Start: "08:00", End: "17:00"}}, weekTime(0, "12:00"), true},
+		{"other weekday", []ScheduleWindow{{Days: []string{"mon"}, Start: "08:00", End: "17:00"}}, weekTime(1, "12:00"), false},
+		{"day case", []ScheduleWindow{{Days: []string{"Sun"}, Start: "08:00", End: "17:00"}}, weekTime(6, "12:00"), true},
+		{"past midnight, evening", []ScheduleWindow{weekdayNights}, weekTime(4, "23:00"), true},
+		{"past midnight, morning after", []ScheduleWindow{weekdayNights}, weekTime(5, "05:59"), true},
+		{"past midnight, ended", []ScheduleWindow{weekdayNights}, weekTime(5, "06:00"), false},
+		{"past midnight, day off evening", []ScheduleWindow{weekdayNights}, weekTime(5, "23:00"), false},
+		{"past midnight, morning after day off", []ScheduleWindow{weekdayNights}, weekTime(0, "01:00"), false},
+		{"past midnight, morning after sunday", []ScheduleWindow{{Days: []string{"sun"}, Start: "22:00", End: "06:00"}}, weekTime(7, "01:00"), true},
+		{"second window", []ScheduleWindow{{Start: "08:00", End: "09:00"}, {Start: "17:00", End: "18:00"}}, weekTime(0, "17:30"), true},
+	}
+	for _, test := range tests {
+		s := Schedule{Windows: test.windows}
+		if err := s.Validate(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := s.IsArmed(test.t, true); got != test.want {
+			t.Errorf("%s: armed at %v is %v, want %v", test.name, test.t.Format("Mon 15:04"), got, test.want)
+		}
+		if s.IsArmed(test.t, false) {
+			t.Errorf("%s: armed at %v with recording switched off", test.name, test.t.Format("Mon 15:04"))
+		}
+	}
+}
+
+func TestScheduleHolidays(t *testing.T) {
+	s := Schedule{
+		Windows: []ScheduleWindow{{Start: "08:00", End: "17:00"}},
+		Holidays: []HolidayOverride{
+			{Date: "2024-01-01", Armed: false},
+			{Date: "2024-01-02", Armed: true},
+		},
+	}
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{weekTime(0, "12:00"), false},
+		{weekTime(1, "03:00"), true},
+		{weekTime(2, "03:00"), false},
+		{weekTime(2, "12:00"), true},
+	}
+	for _, test := range tests {
+		if got := s.IsArmed(test.t, true); got != test.want {
+			t.Errorf("armed at %v is %v, want %v", test.t.Format("2006-01-02 15:04"), got, test.want)
+		}
+	}
+}
+
+func TestScheduleOverride(t *testing.T) {
+	tests := []struct {
+		name      string
+		armed     bool
+		d         time.Duration
+		requested bool
+		after     time.Duration
+		want      bool
+	}{
+		{"arm", true, time.Hour, false, 0, true},
+		{"arm expired", true, time.Hour, false, time.Hour + time.Second, false},
+		{"disarm", false, time.Hour, true, 0, false},
+		{"disarm expired", false, time.Hour, true, time.Hour + time.Second, true},
+		{"cleared", true, 0, false, 0, false},
+	}
+	for _, test := range tests {
+		s := Schedule{}
+		s.Override(test.armed, test.d)
+		now := time.Now()
+		if got := s.IsArmed(now.Add(test.after), test.requested); got != test.want {
+			t.Errorf("%s: armed is %v, want %v", test.name, got, test.want)
+		}
+		if _, _, ok := s.GetOverride(); ok != (test.d > 0) {
+			t.Errorf("%s: override active is %v, want %v", test.name, ok, test.d > 0)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := []struct {
+		windows  []ScheduleWindow
+		holidays []HolidayOverride
+		ok       bool
+	}{
+		{[]ScheduleWindow{{Start: "00:00", End: "24:00"}}, nil, true},
+		{[]ScheduleWindow{{Days: []string{"monday"}, Start: "08:00", End: "17:00"}}, nil, false},
+		{[]ScheduleWindow{{Start: "8", End: "17:00"}}, nil, false},
+		{[]ScheduleWindow{{Start: "08:00", End: "25:00"}}, nil, false},
+		{nil, []HolidayOverride{{Date: "01/02/2024"}}, false},
+	}
+	for i, test := range tests {
+		s := Schedule{Windows: test.windows, Holidays: test.holidays}
+		if err := s.Validate(); (err == nil) != test.ok {
+			t.Errorf("case %d: Validate returned %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package raspivid
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"log"
+	"sentry-picam/broker"
+	"sync"
+	"time"
+)
+
+const maxCachedSnapshots = 8
+
+type snapshotKey struct {
+	width   int
+	quality int
+}
+
+// Snapshot keeps the latest keyframe of the video stream to serve still images of it.
+// Images are made once per keyframe and size, however many clients ask for them.
+type Snapshot struct {
+	lock     sync.Mutex
+	pending  [][]byte // parameter sets and slices of the keyframe being received
+	keyframe [][]byte
+	received time.Time
+
+	imageLock sync.Mutex // held while decoding so concurrent requests wait for one result
+	decoded   *image.YCbCr
+	decodedAt time.Time // when the decoded keyframe was received
+	failedAt  time.Time // when the last keyframe that couldn't be decoded was received
+	cache     map[snapshotKey][]byte
+}
+
+// Start keeps the latest complete keyframe of the video stream
+func (s *Snapshot) Start(caster *broker.Broker) {
+	stream := caster.Subscribe()
+	defer caster.Unsubscribe(stream)
+
+	for x := range stream {
+		packet := x.([]byte)
+		if len(packet) < 6 {
+			continue
+		}
+		nal := packet[4:]
+
+		s.lock.Lock()
+		switch nal[0] & 0x1f {
+		case nalSPS:
+			s.finishKeyframe()
+			s.pending = [][]byte{nal}
+		case nalPPS:
+			if s.pending != nil {
+				s.pending = append(s.pending, nal)
+			}
+		case nalIDRSlice:
+			if s.pending != nil {
+				s.pending = append(s.pending, nal)
+			}
+		case nalSlice:
+			s.finishKeyframe()
+		}
+		s.lock.Unlock()
+	}
+}
+
+// finishKeyframe makes the keyframe being received the latest if it has any slices. lock must be held.
+func (s *Snapshot) finishKeyframe() {
+	if len(s.pending) > 2 {
+		s.keyframe = s.pending
+		s.received = time.Now()
+	}
+	s.pending = nil
+}
+
+// latest returns the latest keyframe and when it was received
+func (s *Snapshot) latest() ([][]byte, time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.keyframe, s.received
+}
+
+// JPEG returns the latest keyframe as a jpg scaled to width, 0 for full size, and when it
+// was received. A keyframe that can't be decoded is skipped in favour of the one before.
+func (s *Snapshot) JPEG(width int, quality int) ([]byte, time.Time, error) {
+	s.imageLock.Lock()
+	defer s.imageLock.Unlock()
+
+	keyframe, received := s.latest()
+	if keyframe == nil {
+		return nil, time.Time{}, errors.New("no keyframe received yet")
+	}
+	if !received.Equal(s.decodedAt) && !received.Equal(s.failedAt) {
+		if img, err := newH264Decoder().decode(keyframe); err == nil {
+			s.decoded, s.decodedAt = img, received
+			s.cache = make(map[snapshotKey][]byte)
+		} else {
+			s.failedAt = received
+			log.Println("Couldn't decode snapshot: " + err.Error())
+		}
+	}
+	if s.decoded == nil {
+		return nil, time.Time{}, errors.New("no keyframe decoded yet")
+	}
+
+	key := snapshotKey{width, quality}
+	if out, ok := s.cache[key]; ok {
+		return out, s.decodedAt, nil
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, scaleImage(s.decoded, width), &jpeg.Options{Quality: quality}); err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(s.cache) >= maxCachedSnapshots {
+		s.cache = make(map[snapshotKey][]byte)
+	}
+	s.cache[key] = b.Bytes()
+	return b.Bytes(), s.decodedAt, nil
+}
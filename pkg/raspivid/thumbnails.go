@@ -0,0 +1,150 @@
+package raspivid
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxPeakThumbnails = 5
+
+// Thumbnails configures the images made for each clip besides its thumbnail
+type Thumbnails struct {
+	SheetFrames int    // frames in a contact sheet of the whole clip, 0 for none
+	Preview     string // format of an animated preview, webp or gif, empty for none
+	Peaks       int    // thumbnails of the moments with the most motion, up to maxPeakThumbnails
+}
+
+// PeakThumbnail is a thumbnail of a moment with a lot of motion
+type PeakThumbnail struct {
+	File   string    `json:"file"`
+	T      time.Time `json:"t"`
+	Offset float64   `json:"offset"` // seconds into the clip
+}
+
+// ThumbnailSet lists the images made for a clip, relative to its folder
+type ThumbnailSet struct {
+	Sheet   string          `json:"sheet,omitempty"`
+	Preview string          `json:"preview,omitempty"`
+	Peaks   []PeakThumbnail `json:"peaks,omitempty"`
+}
+
+// thumbnailExtensions are the images that may be saved with a recording
+var thumbnailExtensions = func() []string {
+	exts := []string{".jpg", ".sheet.jpg", ".preview.webp", ".preview.gif"}
+	for i := 1; i <= maxPeakThumbnails; i++ {
+		exts = append(exts, ".peak"+strconv.Itoa(i)+".jpg")
+	}
+	return exts
+}()
+
+// makeContactSheet tiles frames evenly spread over a video of length seconds into a jpg
+func makeContactSheet(video string, jpg string, frames int, length float64) error {
+	cols := int(math.Ceil(math.Sqrt(float64(frames))))
+	rows := (frames + cols - 1) / cols
+	cmd := exec.Command("nice", "-19",
+		"ffmpeg", "-y",
+		"-i", video,
+		"-vf", fmt.Sprintf("fps=%f,scale=320:-1,tile=%dx%d", float64(frames)/length, cols, rows),
+		"-qscale:v", "16",
+		"-frames:v", "1",
+		jpg,
+	)
+	return runFfmpeg(cmd)
+}
+
+// makePreview saves a short looping animation of a video of length seconds, in the format
+// given by the extension of dst
+func makePreview(video string, dst string, length float64) error {
+	const frames, framerate = 16, 4
+	args := []string{"-19",
+		"ffmpeg", "-y",
+		"-i", video,
+		"-vf", fmt.Sprintf("fps=%f,scale=320:-1,setpts=N/(%d*TB)", frames/length, framerate),
+		"-frames:v", strconv.Itoa(frames),
+		"-loop", "0",
+		"-an",
+	}
+	if strings.HasSuffix(dst, ".webp") {
+		args = append(args, "-c:v", "libwebp", "-quality", "50")
+	}
+	return runFfmpeg(exec.Command("nice", append(args, dst)...))
+}
+
+// motionPeaks returns up to n moments of an event when the largest objects were tracked,
+// at least a second apart
+func motionPeaks(e EventInfo, n int) []time.Time {
+	points := []TrackPoint{}
+	for _, t := range e.Tracks {
+		points = append(points, t.Path...)
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Size > points[j].Size })
+
+	peaks := []time.Time{}
+	for _, p := range points {
+		if len(peaks) == n {
+			break
+		}
+		near := false
+		for _, t := range peaks {
+			if d := p.T.Sub(t); d < time.Second && d > -time.Second {
+				near = true
+				break
+			}
+		}
+		if !near && !p.T.Before(e.ClipStart) && p.T.Before(e.End) {
+			peaks = append(peaks, p.T)
+		}
+	}
+	sort.Slice(peaks, func(i, j int) bool { return peaks[i].Before(peaks[j]) })
+	return peaks
+}
+
+// makeThumbnailSet creates the configured images for a converted clip and records them in
+// its metadata
+func (conv *Converter) makeThumbnailSet(dir string, name string) {
+	opts := conv.recorder.Thumbnails
+	if opts.SheetFrames <= 0 && opts.Preview == "" && opts.Peaks <= 0 {
+		return
+	}
+	e, err := ReadEvent(dir + name + ".json")
+	if err != nil || e.ClipStart.IsZero() {
+		return // the length of the clip is unknown
+	}
+	length := e.End.Sub(e.ClipStart).Seconds()
+	if length <= 0 {
+		return
+	}
+
+	video := dir + name + ".mp4"
+	set := ThumbnailSet{}
+	if opts.SheetFrames > 0 && makeContactSheet(video, dir+name+".sheet.jpg", opts.SheetFrames, length) == nil {
+		set.Sheet = name + ".sheet.jpg"
+	}
+	if opts.Preview == "webp" || opts.Preview == "gif" {
+		file := name + ".preview." + opts.Preview
+		if makePreview(video, dir+file, length) == nil {
+			set.Preview = file
+		} else {
+			os.Remove(dir + file)
+		}
+	}
+	peaks := opts.Peaks
+	if peaks > maxPeakThumbnails {
+		peaks = maxPeakThumbnails
+	}
+	for i, t := range motionPeaks(e, peaks) {
+		p := PeakThumbnail{File: name + ".peak" + strconv.Itoa(i+1) + ".jpg", T: t, Offset: t.Sub(e.ClipStart).Seconds()}
+		if makeThumbnail(video, dir+p.File, p.Offset) == nil {
+			set.Peaks = append(set.Peaks, p)
+		}
+	}
+
+	e.Thumbnails = set
+	WriteEvent(dir+name+".json", e)
+}
@@ -0,0 +1,180 @@
+package raspivid
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Coverage kinds
+const (
+	CoverageContinuous = "continuous"
+	CoverageEvent      = "event"
+)
+
+// Coverage is a recorded file covering a span of time
+type Coverage struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	File  string    `json:"file"` // relative to the recording folder
+	Kind  string    `json:"kind"`
+}
+
+// Timeline is what was recorded during a day
+type Timeline struct {
+	Date    string     `json:"date"`
+	Covered []Coverage `json:"covered"`
+	Motion  []Interval `json:"motion"` // overlapping motion is merged
+}
+
+// videoFile returns the name of the video saved in dir, preferring mp4 over raw h264
+func videoFile(dir string, name string) string {
+	for _, ext := range []string{".mp4", ".h264"} {
+		if _, err := os.Stat(dir + name + ext); err == nil {
+			return name + ext
+		}
+	}
+	return ""
+}
+
+// parseRecordingName returns the time a recording was named after
+func parseRecordingName(name string) (time.Time, error) {
+	if t, err := time.ParseInLocation(segmentNameFormat, name, time.Local); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02-1504", name, time.Local)
+}
+
+// daySegments returns the segments stored for a day
+func daySegments(folder string, day time.Time) ([]Coverage, []Interval) {
+	covered := []Coverage{}
+	motion := []Interval{}
+
+	dir := folder + ContinuousFolder + day.Format("2006-01-02") + "/"
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		s, err := ReadSegment(dir + f.Name())
+		video := videoFile(dir, s.Name)
+		if err != nil || video == "" {
+			continue
+		}
+		covered = append(covered, Coverage{s.Start, s.End, ContinuousFolder + day.Format("2006-01-02") + "/" + video, CoverageContinuous})
+		motion = append(motion, s.Motion...)
+	}
+	return covered, motion
+}
+
+// dayEvents returns the event recordings made on a day
+func dayEvents(folder string, day time.Time) ([]Coverage, []Interval) {
+	covered := []Coverage{}
+	motion := []Interval{}
+
+	month := day.Format("2006-01") + "/"
+	prefix := day.Format("2006-01-02") + "-"
+	files, _ := os.ReadDir(folder + month)
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if ext != ".mp4" && ext != ".h264" || !strings.HasPrefix(f.Name(), prefix) {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), ext)
+		if videoFile(folder+month, name) != f.Name() {
+			continue // listed under its mp4
+		}
+
+		c := Coverage{File: month + f.Name(), Kind: CoverageEvent}
+		if e, err := ReadEvent(folder + month + name + ".json"); err == nil {
+			c.Start, c.End = e.ClipStart, e.End
+			if c.Start.IsZero() {
+				c.Start = e.Start
+			}
+			motion = append(motion, Interval{e.Start, e.End})
+		} else {
+			// older recordings without metadata only have their name and modification time
+			if c.Start, err = parseRecordingName(name); err != nil {
+				continue
+			}
+			if info, err := f.Info(); err == nil {
+				c.End = info.ModTime()
+			}
+		}
+		covered = append(covered, c)
+	}
+	return covered, motion
+}
+
+// mergeIntervals sorts intervals and joins the ones that overlap
+func mergeIntervals(intervals []Interval) []Interval {
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start.Before(intervals[j].Start) })
+
+	merged := []Interval{}
+	for _, v := range intervals {
+		if n := len(merged); n > 0 && !v.Start.After(merged[n-1].End) {
+			if v.End.After(merged[n-1].End) {
+				merged[n-1].End = v.End
+			}
+			continue
+		}
+		merged = append(merged, v)
+	}
+	return merged
+}
+
+// GetTimeline returns the recordings and motion of a day across storage tiers.
+// folders must include the trailing slash.
+func GetTimeline(folders []string, day time.Time) Timeline {
+	dayStart := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	dayEnd := dayStart.AddDate(0, 0, 1)
+
+	covered := []Coverage{}
+	motion := []Interval{}
+	for _, folder := range folders {
+		// the last recording of the previous day may run past midnight
+		for _, d := range []time.Time{dayStart.AddDate(0, 0, -1), dayStart} {
+			for _, get := range []func(string, time.Time) ([]Coverage, []Interval){daySegments, dayEvents} {
+				c, m := get(folder, d)
+				covered = append(covered, c...)
+				motion = append(motion, m...)
+			}
+		}
+	}
+
+	t := Timeline{Date: dayStart.Format("2006-01-02"), Covered: []Coverage{}, Motion: []Interval{}}
+	for _, c := range covered {
+		if c.End.After(dayStart) && c.Start.Before(dayEnd) {
+			t.Covered = append(t.Covered, c)
+		}
+	}
+	for _, m := range motion {
+		if m.End.After(dayStart) && m.Start.Before(dayEnd) {
+			t.Motion = append(t.Motion, m)
+		}
+	}
+	sort.Slice(t.Covered, func(i, j int) bool { return t.Covered[i].Start.Before(t.Covered[j].Start) })
+	t.Motion = mergeIntervals(t.Motion)
+	return t
+}
+
+// Resolve finds the recording covering a moment, preferring continuous segments,
+// and returns it with the offset of the moment into the file
+func Resolve(folders []string, at time.Time) (Coverage, time.Duration, bool) {
+	var found *Coverage
+	timeline := GetTimeline(folders, at)
+	for i, c := range timeline.Covered {
+		if at.Before(c.Start) || !at.Before(c.End) {
+			continue
+		}
+		if found == nil || (c.Kind == CoverageContinuous && found.Kind != CoverageContinuous) {
+			found = &timeline.Covered[i]
+		}
+	}
+	if found == nil {
+		return Coverage{}, 0, false
+	}
+	return *found, at.Sub(found.Start), true
+}
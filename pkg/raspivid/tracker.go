@@ -0,0 +1,342 @@
+package raspivid
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxTrackPoints = 300 // longer paths keep every other point
+
+// Track directions
+const (
+	LeftToRight = "left-to-right"
+	RightToLeft = "right-to-left"
+	TopToBottom = "top-to-bottom"
+	BottomToTop = "bottom-to-top"
+)
+
+// blob is a group of adjacent triggered motion blocks
+type blob struct {
+	size                   int
+	x, y                   float64 // centroid
+	minX, minY, maxX, maxY int
+}
+
+// blobFinder groups triggered blocks into blobs, reusing its buffers between frames
+type blobFinder struct {
+	visited []bool
+	stack   []int
+	blobs   []blob
+}
+
+func (b *blobFinder) find(frame *[]motionVector, cols int) []blob {
+	if len(b.visited) != len(*frame) {
+		b.visited = make([]bool, len(*frame))
+		b.stack = make([]int, 0, len(*frame))
+	}
+	for i := range b.visited {
+		b.visited[i] = false
+	}
+
+	b.blobs = b.blobs[:0]
+	for i, v := range *frame {
+		if v.X == 0 || b.visited[i] {
+			continue
+		}
+
+		bl := blob{minX: cols, minY: len(*frame)}
+		b.visited[i] = true
+		b.stack = append(b.stack[:0], i)
+		for len(b.stack) > 0 {
+			n := b.stack[len(b.stack)-1]
+			b.stack = b.stack[:len(b.stack)-1]
+
+			x := n % cols
+			y := n / cols
+			bl.size++
+			bl.x += float64(x)
+			bl.y += float64(y)
+			if x < bl.minX {
+				bl.minX = x
+			}
+			if x > bl.maxX {
+				bl.maxX = x
+			}
+			if y < bl.minY {
+				bl.minY = y
+			}
+			if y > bl.maxY {
+				bl.maxY = y
+			}
+
+			for _, next := range [4]int{n - cols, n + cols, n - 1, n + 1} {
+				if next < 0 || next >= len(*frame) || b.visited[next] || (*frame)[next].X == 0 {
+					continue
+				}
+				if (next == n-1 && x == 0) || (next == n+1 && x == cols-1) { // don't wrap rows
+					continue
+				}
+				b.visited[next] = true
+				b.stack = append(b.stack, next)
+			}
+		}
+
+		bl.x /= float64(bl.size)
+		bl.y /= float64(bl.size)
+		b.blobs = append(b.blobs, bl)
+	}
+	return b.blobs
+}
+
+// edge returns the edge of the frame the blob touches, preferring the one nearest its centroid
+func (bl *blob) edge(cols, rows int) string {
+	edge := ""
+	best := math.MaxFloat64
+	check := func(touches bool, name string, dist float64) {
+		if touches && dist < best {
+			edge = name
+			best = dist
+		}
+	}
+	check(bl.minX == 0, "left", bl.x)
+	check(bl.maxX == cols-1, "right", float64(cols-1)-bl.x)
+	check(bl.minY == 0, "top", bl.y)
+	check(bl.maxY == rows-1, "bottom", float64(rows-1)-bl.y)
+	return edge
+}
+
+// TrackPoint is the centroid of a tracked object, in motion blocks
+type TrackPoint struct {
+	X    float64   `json:"x"`
+	Y    float64   `json:"y"`
+	Size int       `json:"size"`
+	T    time.Time `json:"t"`
+}
+
+// Track follows a moving object across frames
+type Track struct {
+	ID        int          `json:"id"`
+	Path      []TrackPoint `json:"path"`
+	EntryEdge string       `json:"entryEdge"` // left, right, top, bottom, or empty if it appeared within the frame
+	ExitEdge  string       `json:"exitEdge"`  // empty if it disappeared within the frame
+	Speed     float64      `json:"speed"`     // blocks per second
+	Dwell     float64      `json:"dwell"`     // seconds in view
+	Truncated bool         `json:"truncated"` // still in progress when the recording ended, see activeTracks
+
+	distance float64
+	missed   int
+	last     blob
+	prev     TrackPoint // previous point, when moved
+	moved    bool       // moved in the latest frame
+}
+
+func (t *Track) add(bl blob, now time.Time) {
+	t.moved = len(t.Path) > 0
+	if t.moved {
+		t.prev = t.Path[len(t.Path)-1]
+		t.distance += math.Hypot(bl.x-t.prev.X, bl.y-t.prev.Y)
+	}
+	if len(t.Path) >= maxTrackPoints {
+		kept := t.Path[:0]
+		for i := 0; i < len(t.Path); i += 2 {
+			kept = append(kept, t.Path[i])
+		}
+		t.Path = kept
+	}
+
+	t.Path = append(t.Path, TrackPoint{bl.x, bl.y, bl.size, now})
+	t.last = bl
+	t.missed = 0
+
+	t.Dwell = now.Sub(t.Path[0].T).Seconds()
+	if t.Dwell > 0 {
+		t.Speed = t.distance / t.Dwell
+	}
+}
+
+// displacement returns how far the object has moved in a direction
+func (t *Track) displacement(direction string) float64 {
+	first := t.Path[0]
+	last := t.Path[len(t.Path)-1]
+	switch direction {
+	case LeftToRight:
+		return last.X - first.X
+	case RightToLeft:
+		return first.X - last.X
+	case TopToBottom:
+		return last.Y - first.Y
+	case BottomToTop:
+		return first.Y - last.Y
+	}
+	return 0
+}
+
+func (t *Track) copy() Track {
+	c := *t
+	c.Path = append([]TrackPoint{}, t.Path...)
+	return c
+}
+
+// TrackRule only allows recordings when an object travels MinDistance blocks in Direction
+type TrackRule struct {
+	Direction   string  `json:"direction"`
+	MinDistance float64 `json:"minDistance"`
+}
+
+// ParseTrackRules parses comma separated rules like "left-to-right:4,bottom-to-top:2"
+func ParseTrackRules(s string) ([]TrackRule, error) {
+	rules := []TrackRule{}
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		parts := strings.SplitN(r, ":", 2)
+		rule := TrackRule{Direction: parts[0], MinDistance: 1}
+		switch rule.Direction {
+		case LeftToRight, RightToLeft, TopToBottom, BottomToTop:
+		default:
+			return nil, fmt.Errorf("invalid track direction %q", rule.Direction)
+		}
+		if len(parts) == 2 {
+			d, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid track distance %q", parts[1])
+			}
+			rule.MinDistance = d
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Tracker follows blobs of motion across frames
+type Tracker struct {
+	MaxDistance float64 // blocks an object may move between frames
+	MaxMissed   int     // frames a track survives without motion
+	MinSize     int     // blobs smaller than this aren't tracked
+	Rules       []TrackRule
+
+	tracks []*Track
+	nextID int
+	lock   sync.Mutex
+}
+
+// update matches blobs to tracks, returning tracks that ended
+func (tr *Tracker) update(blobs []blob, now time.Time, cols, rows int) []Track {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	matched := make([]bool, len(blobs))
+	for _, t := range tr.tracks {
+		best := -1
+		bestDist := tr.MaxDistance * float64(t.missed+1)
+		for i, bl := range blobs {
+			if matched[i] || bl.size < tr.MinSize {
+				continue
+			}
+			if d := math.Hypot(bl.x-t.last.x, bl.y-t.last.y); d <= bestDist {
+				best = i
+				bestDist = d
+			}
+		}
+
+		if best >= 0 {
+			matched[best] = true
+			t.add(blobs[best], now)
+		} else {
+			t.missed++
+			t.moved = false
+		}
+	}
+
+	for i, bl := range blobs {
+		if matched[i] || bl.size < tr.MinSize {
+			continue
+		}
+		tr.nextID++
+		t := &Track{ID: tr.nextID, EntryEdge: bl.edge(cols, rows)}
+		t.add(bl, now)
+		tr.tracks = append(tr.tracks, t)
+	}
+
+	ended := []Track{}
+	active := tr.tracks[:0]
+	for _, t := range tr.tracks {
+		if t.missed > tr.MaxMissed {
+			t.ExitEdge = t.last.edge(cols, rows)
+			ended = append(ended, *t)
+		} else {
+			active = append(active, t)
+		}
+	}
+	tr.tracks = active
+	return ended
+}
+
+// matchesRules reports if any active track satisfies a rule. Always true without rules.
+func (tr *Tracker) matchesRules() bool {
+	if len(tr.Rules) == 0 {
+		return true
+	}
+
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	for _, t := range tr.tracks {
+		for _, r := range tr.Rules {
+			if t.displacement(r.Direction) >= r.MinDistance {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UseTracker makes the recorder save tracks still in progress when a recording ends.
+// Call it before starting motion detection and recording.
+func (rec *Recorder) UseTracker(tr *Tracker) {
+	rec.tracker = tr
+}
+
+// activeTracks returns copies of tracks still in progress, marked as truncated. The whole
+// track is saved again with the event it ends in.
+func (tr *Tracker) activeTracks() []Track {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	tracks := []Track{}
+	for _, t := range tr.tracks {
+		if len(t.Path) > 1 {
+			c := t.copy()
+			c.Truncated = true
+			tracks = append(tracks, c)
+		}
+	}
+	return tracks
+}
+
+// trackStep is the movement of a track in the latest frame
+type trackStep struct {
+	id       int
+	from, to TrackPoint
+}
+
+// steps returns the movement of each track in the latest frame
+func (tr *Tracker) steps() []trackStep {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	steps := []trackStep{}
+	for _, t := range tr.tracks {
+		if t.moved {
+			steps = append(steps, trackStep{t.ID, t.prev, t.Path[len(t.Path)-1]})
+		}
+	}
+	return steps
+}
@@ -0,0 +1,246 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrashFolder holds discarded recordings until they're purged
+const TrashFolder = "deleteme/"
+
+const trashPurgeInterval = 10 * time.Minute
+
+var recordingExtensions = append([]string{".mp4", ".h264", ".json"}, thumbnailExtensions...)
+
+// recordingName returns the name of the recording a file belongs to. Extra thumbnails are
+// named like name.sheet.jpg.
+func recordingName(file string) string {
+	return strings.SplitN(file, ".", 2)[0]
+}
+
+// TrashItem is a discarded recording
+type TrashItem struct {
+	Name    string    `json:"name"`
+	Folder  string    `json:"folder"` // day folder it was discarded from, relative to the recording folder
+	Deleted time.Time `json:"deleted"`
+	Bytes   uint64    `json:"bytes"`
+}
+
+// Trash keeps discarded recordings for PurgeAge so they can be restored
+type Trash struct {
+	PurgeAge time.Duration
+	Archive  string // second storage tier recordings may also be discarded from
+
+	items  map[string]TrashItem
+	folder string
+	lock   sync.Mutex
+}
+
+// Load reads the list of discarded recordings from the trash folder in folder.
+// folder must include the trailing slash.
+func (t *Trash) Load(folder string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.folder = folder
+	t.items = make(map[string]TrashItem)
+	os.MkdirAll(t.dir(), 0777)
+
+	f, err := os.ReadFile(t.dir() + "trash.json")
+	if err == nil {
+		items := []TrashItem{}
+		if err := json.Unmarshal(f, &items); err != nil {
+			log.Println("Couldn't load trash: " + err.Error())
+		}
+		for _, v := range items {
+			t.items[v.Name] = v
+		}
+	}
+	t.sync()
+}
+
+func (t *Trash) dir() string {
+	return t.folder + TrashFolder
+}
+
+// dayFolder returns the folder recordings named like name are saved in
+func dayFolder(name string) string {
+	s := strings.Split(name, "-")
+	if len(s) < 2 {
+		return ""
+	}
+	return s[0] + "-" + s[1] + "/"
+}
+
+// sync matches the list to the files in the trash folder, counting recordings discarded
+// before the list existed as discarded now. lock must be held.
+func (t *Trash) sync() {
+	files, err := os.ReadDir(t.dir())
+	if err != nil {
+		return
+	}
+
+	found := make(map[string]uint64)
+	for _, f := range files {
+		name := recordingName(f.Name())
+		if _, err := parseRecordingName(name); err != nil || f.IsDir() {
+			continue
+		}
+		if info, err := f.Info(); err == nil {
+			found[name] += uint64(info.Size())
+		}
+	}
+
+	for name := range t.items {
+		if _, ok := found[name]; !ok {
+			delete(t.items, name)
+		}
+	}
+	for name, size := range found {
+		item, ok := t.items[name]
+		if !ok {
+			item = TrashItem{Name: name, Folder: dayFolder(name), Deleted: time.Now()}
+		}
+		item.Bytes = size
+		t.items[name] = item
+	}
+	t.save()
+}
+
+// save writes the list of discarded recordings to disk. lock must be held.
+func (t *Trash) save() {
+	out, err := json.MarshalIndent(t.list(), "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(t.dir()+"trash.json", out, 0600); err != nil {
+		log.Println("Couldn't save trash: " + err.Error())
+	}
+}
+
+// list returns the discarded recordings, most recently discarded first. lock must be held.
+func (t *Trash) list() []TrashItem {
+	items := []TrashItem{}
+	for _, v := range t.items {
+		items = append(items, v)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	return items
+}
+
+// List returns the discarded recordings, most recently discarded first
+func (t *Trash) List() []TrashItem {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.sync()
+	return t.list()
+}
+
+// moveFiles moves the files of a recording between folders, returning os.ErrNotExist if
+// there were none
+func moveFiles(from string, to string, name string) error {
+	moved := false
+	for _, ext := range recordingExtensions {
+		err := moveFile(from+name+ext, to+name+ext)
+		if err == nil {
+			moved = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !moved {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// Discard moves a recording to the trash
+func (t *Trash) Discard(name string) error {
+	folder := dayFolder(name)
+	if folder == "" {
+		return os.ErrNotExist
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	err := moveFiles(t.folder+folder, t.dir(), name)
+	if os.IsNotExist(err) && t.Archive != "" {
+		err = moveFiles(t.Archive+folder, t.dir(), name)
+	}
+	if err != nil {
+		return err
+	}
+	t.items[name] = TrashItem{Name: name, Folder: folder, Deleted: time.Now()}
+	t.sync()
+	return nil
+}
+
+// Restore moves a discarded recording back to the folder it was discarded from
+func (t *Trash) Restore(name string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	item, ok := t.items[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if strings.Contains(item.Folder, "..") {
+		return errors.New("invalid folder " + item.Folder)
+	}
+
+	os.MkdirAll(t.folder+item.Folder, 0777)
+	if err := moveFiles(t.dir(), t.folder+item.Folder, name); err != nil {
+		return err
+	}
+	delete(t.items, name)
+	t.save()
+	return nil
+}
+
+// Purge permanently deletes recordings discarded more than maxAge ago, returning the
+// names of those deleted
+func (t *Trash) Purge(maxAge time.Duration) []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.sync()
+	purged := []string{}
+	for name, item := range t.items {
+		if time.Since(item.Deleted) < maxAge {
+			continue
+		}
+		failed := false
+		for _, ext := range recordingExtensions {
+			if err := os.Remove(t.dir() + name + ext); err != nil && !os.IsNotExist(err) {
+				log.Println("Couldn't purge " + name + ": " + err.Error())
+				failed = true
+			}
+		}
+		if !failed {
+			delete(t.items, name)
+			purged = append(purged, name)
+		}
+	}
+	if len(purged) > 0 {
+		t.save()
+	}
+	return purged
+}
+
+// PurgePeriodically deletes recordings discarded more than PurgeAge ago in the background
+func (t *Trash) PurgePeriodically() {
+	for {
+		if purged := t.Purge(t.PurgeAge); len(purged) > 0 {
+			log.Printf("Purged %d recordings from the trash\n", len(purged))
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
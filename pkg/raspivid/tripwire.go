@@ -0,0 +1,272 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+const tripwireSaveInterval = time.Minute
+
+// Tripwire is a virtual line that fires when a tracked object crosses it.
+// A and B are corners on the motion block grid.
+type Tripwire struct {
+	Name      string    `json:"name"`
+	A         ZonePoint `json:"a"`
+	B         ZonePoint `json:"b"`
+	Direction string    `json:"direction"` // only fire for crossings in this direction, empty for both
+	Action    string    `json:"action"`    // record or notify
+}
+
+// Crossing is a tracked object crossing a tripwire
+type Crossing struct {
+	Tripwire  string    `json:"tripwire"`
+	Direction string    `json:"direction"`
+	Track     int       `json:"track"`
+	T         time.Time `json:"t"`
+}
+
+// tripwireState is saved to disk so counts survive restarts
+type tripwireState struct {
+	Tripwires []Tripwire                `json:"tripwires"`
+	Counts    map[string]map[string]int `json:"counts"` // crossings by tripwire and direction
+}
+
+// Tripwires stores the configured tripwires and their crossing counts
+type Tripwires struct {
+	state    tripwireState
+	file     string
+	lock     sync.Mutex
+	unsaved  bool // counts changed since the last save
+	lastSave time.Time
+}
+
+// crossDirection names the direction of a crossing. Mostly vertical lines are crossed
+// left-to-right or right-to-left, mostly horizontal lines top-to-bottom or bottom-to-top.
+func (t *Tripwire) crossDirection(from, to TrackPoint) string {
+	dx := float64(t.B.X - t.A.X)
+	dy := float64(t.B.Y - t.A.Y)
+	if math.Abs(dy) >= math.Abs(dx) {
+		if to.X > from.X {
+			return LeftToRight
+		}
+		return RightToLeft
+	}
+	if to.Y > from.Y {
+		return TopToBottom
+	}
+	return BottomToTop
+}
+
+// crossed reports if the movement from one centroid to the next crosses the line
+func (t *Tripwire) crossed(from, to TrackPoint) bool {
+	side := func(x, y float64) float64 {
+		return float64(t.B.X-t.A.X)*(y-float64(t.A.Y)) - float64(t.B.Y-t.A.Y)*(x-float64(t.A.X))
+	}
+	// centroids are block indexes, the line is on block corners
+	fx, fy := from.X+.5, from.Y+.5
+	tx, ty := to.X+.5, to.Y+.5
+
+	s1 := side(fx, fy)
+	s2 := side(tx, ty)
+	if s1 == 0 || s2 == 0 || (s1 > 0) == (s2 > 0) {
+		return false
+	}
+
+	// the line segment must also straddle the movement
+	move := func(x, y float64) float64 {
+		return (tx-fx)*(y-fy) - (ty-fy)*(x-fx)
+	}
+	m1 := move(float64(t.A.X), float64(t.A.Y))
+	m2 := move(float64(t.B.X), float64(t.B.Y))
+	return (m1 > 0) != (m2 > 0) || m1 == 0 || m2 == 0
+}
+
+func (t *Tripwire) validate(cols, rows int) error {
+	if t.Name == "" {
+		return errors.New("tripwire name is required")
+	}
+	switch t.Direction {
+	case "", LeftToRight, RightToLeft, TopToBottom, BottomToTop:
+	default:
+		return fmt.Errorf("tripwire %s: invalid direction %q", t.Name, t.Direction)
+	}
+	switch t.Action {
+	case "":
+		t.Action = ZoneNotify
+	case ZoneRecord, ZoneNotify:
+	default:
+		return fmt.Errorf("tripwire %s: action must be record or notify", t.Name)
+	}
+	if t.A == t.B {
+		return fmt.Errorf("tripwire %s: a and b must be different points", t.Name)
+	}
+	for _, p := range []ZonePoint{t.A, t.B} {
+		if p.X < 0 || p.Y < 0 || p.X > cols || p.Y > rows {
+			return fmt.Errorf("tripwire %s: points must fit within the %dx%d grid", t.Name, cols, rows)
+		}
+	}
+	return nil
+}
+
+// Get returns the tripwires and a copy of their crossing counts
+func (tw *Tripwires) Get() ([]Tripwire, map[string]map[string]int) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	counts := make(map[string]map[string]int)
+	for name, dirs := range tw.state.Counts {
+		counts[name] = make(map[string]int)
+		for dir, n := range dirs {
+			counts[name][dir] = n
+		}
+	}
+	return append([]Tripwire{}, tw.state.Tripwires...), counts
+}
+
+// Set validates and applies tripwires on a cols x rows grid, then saves them to disk
+func (tw *Tripwires) Set(tripwires []Tripwire, cols, rows int) error {
+	names := make(map[string]bool)
+	for i := range tripwires {
+		if err := tripwires[i].validate(cols, rows); err != nil {
+			return err
+		}
+		if names[tripwires[i].Name] {
+			return errors.New("duplicate tripwire name " + tripwires[i].Name)
+		}
+		names[tripwires[i].Name] = true
+	}
+
+	tw.lock.Lock()
+	tw.state.Tripwires = tripwires
+	tw.lock.Unlock()
+	return tw.save()
+}
+
+// ResetCounts clears the crossing counts
+func (tw *Tripwires) ResetCounts() error {
+	tw.lock.Lock()
+	tw.state.Counts = make(map[string]map[string]int)
+	tw.lock.Unlock()
+	return tw.save()
+}
+
+func (tw *Tripwires) save() error {
+	if tw.file == "" {
+		return nil
+	}
+
+	tw.lock.Lock()
+	out, err := json.MarshalIndent(tw.state, "", "  ")
+	tw.unsaved = false
+	tw.lastSave = time.Now()
+	tw.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(tw.file, out, 0600)
+}
+
+// saveCounts saves changed crossing counts at most every tripwireSaveInterval, so a busy
+// tripwire doesn't write to the SD card on every crossing
+func (tw *Tripwires) saveCounts() {
+	tw.lock.Lock()
+	due := tw.unsaved && time.Since(tw.lastSave) >= tripwireSaveInterval
+	tw.lock.Unlock()
+	if !due {
+		return
+	}
+	if err := tw.save(); err != nil {
+		log.Println("Couldn't save tripwire counts: " + err.Error())
+	}
+}
+
+// load reads previously saved tripwires and counts. Later changes are saved to the same file.
+func (tw *Tripwires) load(file string, cols, rows int) {
+	tw.file = file
+	tw.state.Counts = make(map[string]map[string]int)
+
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	state := tripwireState{}
+	if err := json.Unmarshal(f, &state); err != nil {
+		log.Println("Couldn't load tripwires: " + err.Error())
+		return
+	}
+	for i := range state.Tripwires {
+		if err := state.Tripwires[i].validate(cols, rows); err != nil {
+			log.Println("Couldn't load tripwires: " + err.Error())
+			return
+		}
+	}
+	if state.Counts == nil {
+		state.Counts = make(map[string]map[string]int)
+	}
+
+	tw.state = state
+	log.Printf("%d tripwires loaded\n", len(state.Tripwires))
+}
+
+// check returns the tripwires crossed by the latest track movements and counts them
+func (tw *Tripwires) check(steps []trackStep) ([]Crossing, []Tripwire) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	crossings := []Crossing{}
+	fired := []Tripwire{}
+	for _, s := range steps {
+		for _, t := range tw.state.Tripwires {
+			if !t.crossed(s.from, s.to) {
+				continue
+			}
+			dir := t.crossDirection(s.from, s.to)
+			if t.Direction != "" && t.Direction != dir {
+				continue
+			}
+
+			if tw.state.Counts[t.Name] == nil {
+				tw.state.Counts[t.Name] = make(map[string]int)
+			}
+			tw.state.Counts[t.Name][dir]++
+			tw.unsaved = true
+			crossings = append(crossings, Crossing{t.Name, dir, s.id, s.to.T})
+			fired = append(fired, t)
+		}
+	}
+	return crossings, fired
+}
+
+// crossTripwires handles tripwires crossed in the latest frame, returning true if one
+// should trigger a recording. Only frames that passed the filters can, and those have
+// already started the event.
+func (c *Motion) crossTripwires(passed bool) bool {
+	crossings, fired := c.Tripwires.check(c.Tracker.steps())
+	if len(crossings) == 0 {
+		return false
+	}
+
+	record := false
+	for i, cr := range crossings {
+		log.Println("Tripwire " + cr.Tripwire + " crossed " + cr.Direction)
+		if fired[i].Action == ZoneRecord {
+			record = passed
+		} else {
+			c.runNotifyScript(cr.Tripwire, cr.Direction)
+		}
+	}
+
+	if time.Now().After(c.recorder.StopTime) && !record {
+		return false // only report crossings during an event
+	}
+	c.recorder.updateEvent(func(e *EventInfo) {
+		e.Crossings = append(e.Crossings, crossings...)
+	})
+	return record
+}
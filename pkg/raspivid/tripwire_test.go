@@ -0,0 +1,55 @@
+package raspivid
+
+import "testing"
+
+func TestTripwireCrossing(t *testing.T) {
+	vertical := Tripwire{A: ZonePoint{X: 4, Y: 0}, B: ZonePoint{X: 4, Y: 8}}
+	horizontal := Tripwire{A: ZonePoint{X: 0, Y: 4}, B: ZonePoint{X: 8, Y: 4}}
+	diagonal := Tripwire{A: ZonePoint{X: 0, Y: 0}, B: ZonePoint{X: 8, Y: 8}}
+
+	// centroids are block indexes, so block 3 is left of the corner at 4 and block 4 right of it
+	tests := []struct {
+		name      string
+		wire      Tripwire
+		from, to  TrackPoint
+		crossed   bool
+		direction string
+	}{
+		{"left to right", vertical, TrackPoint{X: 2, Y: 3}, TrackPoint{X: 5, Y: 3}, true, LeftToRight},
+		{"right to left", vertical, TrackPoint{X: 4, Y: 3}, TrackPoint{X: 3, Y: 3}, true, RightToLeft},
+		{"slanted", vertical, TrackPoint{X: 1, Y: 1}, TrackPoint{X: 6, Y: 6}, true, LeftToRight},
+		{"top to bottom", horizontal, TrackPoint{X: 3, Y: 2}, TrackPoint{X: 3, Y: 6}, true, TopToBottom},
+		{"bottom to top", horizontal, TrackPoint{X: 3, Y: 6}, TrackPoint{X: 1, Y: 3}, true, BottomToTop},
+		{"diagonal", diagonal, TrackPoint{X: 5, Y: 1}, TrackPoint{X: 1, Y: 5}, true, RightToLeft},
+		{"through an end", vertical, TrackPoint{X: 1.5, Y: 7.5}, TrackPoint{X: 5.5, Y: 7.5}, true, LeftToRight},
+		{"same side", vertical, TrackPoint{X: 1, Y: 3}, TrackPoint{X: 3, Y: 5}, false, ""},
+		{"past the end", vertical, TrackPoint{X: 2, Y: 9}, TrackPoint{X: 6, Y: 9}, false, ""},
+		{"before the start", Tripwire{A: ZonePoint{X: 4, Y: 4}, B: ZonePoint{X: 4, Y: 8}},
+			TrackPoint{X: 2, Y: 2}, TrackPoint{X: 6, Y: 2}, false, ""},
+		{"touches the line", vertical, TrackPoint{X: 2, Y: 3}, TrackPoint{X: 3.5, Y: 3}, false, ""},
+		{"leaves the line", vertical, TrackPoint{X: 3.5, Y: 3}, TrackPoint{X: 5, Y: 3}, false, ""},
+		{"along the line", vertical, TrackPoint{X: 3.5, Y: 1}, TrackPoint{X: 3.5, Y: 5}, false, ""},
+		{"collinear past the end", vertical, TrackPoint{X: 3.5, Y: 9}, TrackPoint{X: 3.5, Y: 12}, false, ""},
+		{"parallel", vertical, TrackPoint{X: 3, Y: 1}, TrackPoint{X: 3, Y: 7}, false, ""},
+		{"standing still", vertical, TrackPoint{X: 3, Y: 3}, TrackPoint{X: 3, Y: 3}, false, ""},
+	}
+	for _, test := range tests {
+		if got := test.wire.crossed(test.from, test.to); got != test.crossed {
+			t.Errorf("%s: crossed is %v, want %v", test.name, got, test.crossed)
+			continue
+		}
+		if !test.crossed {
+			continue
+		}
+		if got := test.wire.crossDirection(test.from, test.to); got != test.direction {
+			t.Errorf("%s: direction is %s, want %s", test.name, got, test.direction)
+		}
+		// the way back crosses the other way
+		if !test.wire.crossed(test.to, test.from) {
+			t.Errorf("%s: reverse movement didn't cross", test.name)
+		}
+		if got := test.wire.crossDirection(test.to, test.from); got == test.direction {
+			t.Errorf("%s: reverse movement is also %s", test.name, got)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package raspivid
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadStallTimeout is how long an HTTP upload may go without sending its body or getting
+// a response before it's given up and retried later
+const uploadStallTimeout = 2 * time.Minute
+
+// uploader copies a local file to remote, a slash separated path below the target's prefix
+type uploader interface {
+	upload(local string, remote string, bytesPerSecond int64) error
+}
+
+// limitedReader slows reads down to bytesPerSecond
+type limitedReader struct {
+	r              io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	n              int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.bytesPerSecond <= 0 {
+		return l.r.Read(p)
+	}
+	if l.start.IsZero() {
+		l.start = time.Now()
+	}
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	expected := time.Duration(float64(l.n) / float64(l.bytesPerSecond) * float64(time.Second))
+	if wait := expected - time.Since(l.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// newUploader parses a target like s3://bucket/prefix, sftp://user@host:22/path,
+// or https://host/path for WebDAV
+func newUploader(o *Offload) (uploader, error) {
+	u, err := url.Parse(o.Target)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+
+	switch u.Scheme {
+	case "s3":
+		if o.AccessKey == "" || o.SecretKey == "" {
+			return nil, errors.New("s3 offload needs an access key and secret key")
+		}
+		endpoint := strings.TrimSuffix(o.S3Endpoint, "/")
+		if endpoint == "" {
+			endpoint = "https://s3.amazonaws.com"
+		}
+		region := o.S3Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &s3Uploader{endpoint, region, u.Host, prefix, o.AccessKey, o.SecretKey}, nil
+	case "http", "https":
+		password, _ := u.User.Password()
+		base := *u
+		base.User = nil
+		base.Path = "/" + prefix
+		return &webdavUploader{strings.TrimSuffix(base.String(), "/"), u.User.Username(), password}, nil
+	case "sftp":
+		if _, err := exec.LookPath("sftp"); err != nil {
+			return nil, errors.New("sftp offload needs the sftp command")
+		}
+		return &sftpUploader{u.User.Username(), u.Hostname(), u.Port(), prefix}, nil
+	}
+	return nil, fmt.Errorf("unsupported offload target %q, expected s3://, sftp://, http:// or https://", o.Target)
+}
+
+// joinRemote joins a prefix and a relative path with slashes
+func joinRemote(prefix string, remote string) string {
+	if prefix == "" {
+		return remote
+	}
+	return prefix + "/" + remote
+}
+
+// s3Uploader puts objects into an S3-compatible bucket with path-style requests
+// signed with AWS Signature Version 4
+type s3Uploader struct {
+	endpoint  string
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signingKey derives the Signature Version 4 key for a day, region and service
+func signingKey(secretKey string, day string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// sign sets x-amz-date and the Authorization header of a request without a query string.
+// path is the escaped path of the request. The host and headers, which must be lower
+// case and sorted, are signed.
+func (s *s3Uploader) sign(req *http.Request, path string, headers []string, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	signed := append([]string{"host"}, headers...)
+	sort.Strings(signed)
+	canonical := req.Method + "\n" + path + "\n\n"
+	for _, h := range signed {
+		if h == "host" {
+			canonical += "host:" + host + "\n"
+		} else {
+			canonical += h + ":" + strings.TrimSpace(req.Header.Get(h)) + "\n"
+		}
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonical += "\n" + signedHeaders + "\n" + payloadHash
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	signature := hex.EncodeToString(hmacSHA256(signingKey(s.secretKey, day, s.region, "s3"), toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3Escape encodes a path the way Signature Version 4 expects
+func s3Escape(path string) string {
+	var b strings.Builder
+	for _, c := range []byte(path) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *s3Uploader) upload(local string, remote string, bytesPerSecond int64) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	path := s3Escape("/" + s.bucket + "/" + joinRemote(s.prefix, remote))
+	req, err := http.NewRequest("PUT", s.endpoint+path, &limitedReader{r: f, bytesPerSecond: bytesPerSecond})
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	s.sign(req, path, []string{"x-amz-content-sha256", "x-amz-date"}, payloadHash, time.Now())
+	return doUpload(req)
+}
+
+// stallReader pushes back a stall timer every time the body of a request is read
+type stallReader struct {
+	io.ReadCloser
+	stall *time.Timer
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	s.stall.Reset(uploadStallTimeout)
+	return s.ReadCloser.Read(p)
+}
+
+// doUpload sends a request, cancelling it once it has made no progress for
+// uploadStallTimeout, so a server that stops answering can't block the offload queue.
+// Uploads throttled to a low rate still make progress, unlike with a fixed timeout.
+func doUpload(req *http.Request) error {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	stall := time.AfterFunc(uploadStallTimeout, cancel)
+	defer stall.Stop()
+
+	req = req.WithContext(ctx)
+	if req.Body != nil {
+		req.Body = &stallReader{req.Body, stall}
+	}
+	err := checkResponse(http.DefaultClient.Do(req))
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("no progress for %v: %w", uploadStallTimeout, err)
+	}
+	return err
+}
+
+// checkResponse turns an unsuccessful HTTP response into an error
+func checkResponse(res *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// webdavUploader puts files on a WebDAV share, creating folders as needed
+type webdavUploader struct {
+	base     string
+	username string
+	password string
+}
+
+func (d *webdavUploader) request(method string, path string, body io.Reader, size int64) error {
+	req, err := http.NewRequest(method, d.base+s3Escape("/"+path), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+	return doUpload(req)
+}
+
+func (d *webdavUploader) upload(local string, remote string, bytesPerSecond int64) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// create parent folders, which fails harmlessly if they exist
+	parts := strings.Split(remote, "/")
+	for i := 1; i < len(parts); i++ {
+		d.request("MKCOL", strings.Join(parts[:i], "/"), nil, 0)
+	}
+	return d.request("PUT", remote, &limitedReader{r: f, bytesPerSecond: bytesPerSecond}, info.Size())
+}
+
+// sftpUploader runs the sftp command, which must be able to log in without a password
+type sftpUploader struct {
+	user   string
+	host   string
+	port   string
+	prefix string
+}
+
+func (s *sftpUploader) upload(local string, remote string, bytesPerSecond int64) error {
+	remote = joinRemote(s.prefix, remote)
+	args := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if s.port != "" {
+		args = append(args, "-P", s.port)
+	}
+	if bytesPerSecond > 0 {
+		args = append(args, "-l", strconv.FormatInt(bytesPerSecond*8/1000+1, 10)) // Kbit/s
+	}
+	host := s.host
+	if s.user != "" {
+		host = s.user + "@" + host
+	}
+	args = append(args, host)
+
+	var batch strings.Builder
+	parts := strings.Split(remote, "/")
+	for i := 1; i < len(parts); i++ {
+		fmt.Fprintf(&batch, "-mkdir \"%s\"\n", strings.Join(parts[:i], "/"))
+	}
+	fmt.Fprintf(&batch, "put \"%s\" \"%s\"\n", local, remote)
+
+	cmd := exec.Command("sftp", args...)
+	cmd.Stdin = strings.NewReader(batch.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package raspivid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Zone actions
+const (
+	ZoneRecord = "record" // motion in the zone records a clip
+	ZoneNotify = "notify" // motion in the zone only runs the notify script
+	ZoneIgnore = "ignore" // motion in the zone is discarded
+)
+
+const zoneNotifyInterval = 10 * time.Second // minimum time between notifications for a zone
+
+// ZonePoint is a coordinate on the motion block grid
+type ZonePoint struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// ZoneRect is a rectangle on the motion block grid
+type ZoneRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// MotionZone is a named area of the frame with its own detection settings.
+// Coordinates are in motion blocks, the same grid as MotionMask.
+// Either Rect or Polygon must be set.
+type MotionZone struct {
+	Name      string      `json:"name"`
+	Rect      *ZoneRect   `json:"rect,omitempty"`
+	Polygon   []ZonePoint `json:"polygon,omitempty"`
+	Threshold int8        `json:"threshold"` // 0 uses mthreshold
+	MinBlocks int         `json:"minBlocks"` // triggered blocks needed before the zone counts as triggered
+	Action    string      `json:"action"`
+}
+
+// zoneFile is how zones are saved, along with the grid they were drawn on
+type zoneFile struct {
+	Cols  int          `json:"cols"`
+	Rows  int          `json:"rows"`
+	Zones []MotionZone `json:"zones"`
+}
+
+// scaleCorner moves a grid corner from a grid of from cells to one of to cells
+func scaleCorner(v int, from int, to int) int {
+	return (v*to + from/2) / from
+}
+
+// rescale resizes a zone drawn on a fromCols x fromRows grid to a cols x rows grid.
+// Rects keep at least one block, and MinBlocks scales with the area of a block.
+func (z *MotionZone) rescale(fromCols, fromRows, cols, rows int, maxThreshold int) {
+	if z.Rect != nil {
+		x0, x1 := scaleCorner(z.Rect.X, fromCols, cols), scaleCorner(z.Rect.X+z.Rect.W, fromCols, cols)
+		y0, y1 := scaleCorner(z.Rect.Y, fromRows, rows), scaleCorner(z.Rect.Y+z.Rect.H, fromRows, rows)
+		if x1 <= x0 {
+			x1 = x0 + 1
+		}
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		if x1 > cols {
+			x0, x1 = cols-(x1-x0), cols
+		}
+		if y1 > rows {
+			y0, y1 = rows-(y1-y0), rows
+		}
+		z.Rect = &ZoneRect{x0, y0, x1 - x0, y1 - y0}
+	}
+	for i, p := range z.Polygon {
+		z.Polygon[i] = ZonePoint{scaleCorner(p.X, fromCols, cols), scaleCorner(p.Y, fromRows, rows)}
+	}
+
+	if z.MinBlocks > 0 {
+		z.MinBlocks = z.MinBlocks * cols * rows / (fromCols * fromRows)
+		if z.MinBlocks < 1 {
+			z.MinBlocks = 1
+		}
+	}
+	if int(z.Threshold) > maxThreshold {
+		z.Threshold = int8(maxThreshold)
+	}
+}
+
+// contains reports if the block at x, y belongs to the zone.
+// Polygons are tested against the center of the block.
+func (z *MotionZone) contains(x, y int) bool {
+	if z.Rect != nil {
+		return x >= z.Rect.X && x < z.Rect.X+z.Rect.W && y >= z.Rect.Y && y < z.Rect.Y+z.Rect.H
+	}
+
+	px := float64(x) + .5
+	py := float64(y) + .5
+	inside := false
+	for i, j := 0, len(z.Polygon)-1; i < len(z.Polygon); j, i = i, i+1 {
+		a := z.Polygon[i]
+		b := z.Polygon[j]
+		if (float64(a.Y) > py) != (float64(b.Y) > py) &&
+			px < float64(b.X-a.X)*(py-float64(a.Y))/float64(b.Y-a.Y)+float64(a.X) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (z *MotionZone) validate(cols, rows int, maxThreshold int) error {
+	if z.Name == "" {
+		return errors.New("zone name is required")
+	}
+	switch z.Action {
+	case ZoneRecord, ZoneNotify, ZoneIgnore:
+	case "":
+		z.Action = ZoneRecord
+	default:
+		return fmt.Errorf("zone %s: invalid action %q", z.Name, z.Action)
+	}
+	if z.Threshold < 0 || int(z.Threshold) > maxThreshold {
+		return fmt.Errorf("zone %s: threshold must be between 0 and %d", z.Name, maxThreshold)
+	}
+	if z.MinBlocks < 0 {
+		return fmt.Errorf("zone %s: minBlocks can't be negative", z.Name)
+	}
+
+	if z.Rect != nil {
+		if z.Rect.W < 1 || z.Rect.H < 1 || z.Rect.X < 0 || z.Rect.Y < 0 ||
+			z.Rect.X+z.Rect.W > cols || z.Rect.Y+z.Rect.H > rows {
+			return fmt.Errorf("zone %s: rect must fit within the %dx%d grid", z.Name, cols, rows)
+		}
+		return nil
+	}
+	if len(z.Polygon) < 3 {
+		return fmt.Errorf("zone %s: a rect or a polygon of at least 3 points is required", z.Name)
+	}
+	for _, p := range z.Polygon {
+		if p.X < 0 || p.Y < 0 || p.X > cols || p.Y > rows {
+			return fmt.Errorf("zone %s: polygon must fit within the %dx%d grid", z.Name, cols, rows)
+		}
+	}
+	return nil
+}
+
+// GridSize returns the number of motion block columns and rows
+func (c *Motion) GridSize() (cols, rows int) {
+	return (c.Width / 16) / c.BlockWidth, (c.Height / 16) / c.BlockWidth
+}
+
+// GetZones returns a copy of the configured motion zones
+func (c *Motion) GetZones() []MotionZone {
+	c.detectLock.Lock()
+	defer c.detectLock.Unlock()
+
+	return append([]MotionZone{}, c.Zones...)
+}
+
+// SetZones validates and applies motion zones, then saves them to disk.
+// Zones listed first take priority where they overlap.
+func (c *Motion) SetZones(zones []MotionZone) error {
+	cols, rows := c.GridSize()
+	names := make(map[string]bool)
+	for i := range zones {
+		if err := zones[i].validate(cols, rows, c.BlockWidth*c.BlockWidth); err != nil {
+			return err
+		}
+		if names[zones[i].Name] {
+			return errors.New("duplicate zone name " + zones[i].Name)
+		}
+		names[zones[i].Name] = true
+	}
+
+	c.applyZones(zones)
+
+	out, err := json.MarshalIndent(zoneFile{cols, rows, zones}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.RecordingFolder+"motionZones.json", out, 0600)
+}
+
+// applyZones maps each motion block to the first zone that contains it
+func (c *Motion) applyZones(zones []MotionZone) {
+	cols, rows := c.GridSize()
+	zoneIndex := make([]int, cols*rows)
+	for i := range zoneIndex {
+		zoneIndex[i] = -1
+		for z := range zones {
+			if zones[z].contains(i%cols, i/cols) {
+				zoneIndex[i] = z
+				break
+			}
+		}
+	}
+
+	c.detectLock.Lock()
+	c.Zones = zones
+	c.zoneIndex = zoneIndex
+	c.zoneCounts = make([]int, len(zones))
+	c.detectLock.Unlock()
+}
+
+// loadZones applies the previously saved motion zones, rescaling them if the resolution or
+// block width has changed
+func (c *Motion) loadZones() {
+	f, err := os.ReadFile(c.RecordingFolder + "motionZones.json")
+	if err != nil {
+		return
+	}
+
+	cols, rows := c.GridSize()
+	saved := zoneFile{}
+	if err := json.Unmarshal(f, &saved); err != nil {
+		// zones saved before the grid was recorded
+		saved = zoneFile{Cols: cols, Rows: rows}
+		if err := json.Unmarshal(f, &saved.Zones); err != nil {
+			log.Println("Couldn't load motion zones: " + err.Error())
+			return
+		}
+	}
+	zones := saved.Zones
+	if saved.Cols > 0 && saved.Rows > 0 && (saved.Cols != cols || saved.Rows != rows) {
+		log.Printf("Rescaling motion zones from %dx%d to %dx%d\n", saved.Cols, saved.Rows, cols, rows)
+		for i := range zones {
+			zones[i].rescale(saved.Cols, saved.Rows, cols, rows, c.BlockWidth*c.BlockWidth)
+		}
+	}
+	for i := range zones {
+		if err := zones[i].validate(cols, rows, c.BlockWidth*c.BlockWidth); err != nil {
+			log.Println("Couldn't load motion zones: " + err.Error())
+			return
+		}
+	}
+
+	c.applyZones(zones)
+	log.Printf("%d motion zones loaded\n", len(zones))
+}
+
+// blockThreshold returns the sensitivity of a motion block. detectLock must be held.
+func (c *Motion) blockThreshold(i int) int8 {
+	if i < len(c.zoneIndex) && c.zoneIndex[i] >= 0 {
+		if t := c.Zones[c.zoneIndex[i]].Threshold; t > 0 {
+			return t
+		}
+	}
+	return c.SenseThreshold
+}
+
+// filterZones discards triggered blocks in ignored zones and in zones that didn't reach
+// their minimum block count. detectLock must be held.
+func (c *Motion) filterZones(frame *[]motionVector) {
+	if len(c.Zones) == 0 {
+		return
+	}
+
+	for i := range c.zoneCounts {
+		c.zoneCounts[i] = 0
+	}
+	for i, v := range *frame {
+		if z := c.zoneIndex[i]; z >= 0 && v.X != 0 {
+			if c.Zones[z].Action == ZoneIgnore {
+				(*frame)[i] = motionVector{}
+			} else {
+				c.zoneCounts[z]++
+			}
+		}
+	}
+	for i, v := range *frame {
+		if z := c.zoneIndex[i]; z >= 0 && v.X != 0 && c.zoneCounts[z] < c.Zones[z].MinBlocks {
+			(*frame)[i] = motionVector{}
+		}
+	}
+}
+
+// triggersRecording reports if any triggered block lies outside of notify-only zones
+func (c *Motion) triggersRecording(frame *[]motionVector) bool {
+	c.detectLock.Lock()
+	defer c.detectLock.Unlock()
+
+	for i, v := range *frame {
+		if v.X == 0 {
+			continue
+		}
+		if i >= len(c.zoneIndex) || c.zoneIndex[i] < 0 || c.Zones[c.zoneIndex[i]].Action == ZoneRecord {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyZones runs NotifyScript with the name of each triggered notify-only zone
+func (c *Motion) notifyZones() {
+	c.detectLock.Lock()
+	defer c.detectLock.Unlock()
+
+	for z, count := range c.zoneCounts {
+		zone := c.Zones[z]
+		if zone.Action != ZoneNotify || count == 0 || count < zone.MinBlocks {
+			continue
+		}
+		if time.Since(c.lastNotify[zone.Name]) < zoneNotifyInterval {
+			continue
+		}
+		c.lastNotify[zone.Name] = time.Now()
+		log.Println("Motion in zone: " + zone.Name)
+		c.runNotifyScript(zone.Name)
+	}
+}
+
+// runNotifyScript runs NotifyScript in the background with args
+func (c *Motion) runNotifyScript(args ...string) {
+	if c.NotifyScript == "" {
+		return
+	}
+
+	cmd := exec.Command("nice", append([]string{"-19", c.NotifyScript}, args...)...)
+	if err := cmd.Start(); err != nil {
+		log.Println(err)
+		return
+	}
+	go cmd.Wait()
+}
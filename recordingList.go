@@ -7,14 +7,17 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sentry-picam/raspivid"
 	"strings"
-	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type RecordingList struct {
-	Folder string
+	Folder  string
+	Archive string // second storage tier, empty if there is none
+	Locks   *raspivid.Locks
+	Trash   *raspivid.Trash
 }
 
 func getFiles(folder string) []string {
@@ -28,7 +31,7 @@ func getFiles(folder string) []string {
 		extension := filepath.Ext(strings.ToLower(f.Name()))
 		name := strings.TrimSuffix(filepath.Base(f.Name()), filepath.Ext(f.Name()))
 
-		if extension == ".jpg" {
+		if extension == ".jpg" && !strings.Contains(name, ".") { // skip extra thumbnails
 			s := strings.Split(f.Name(), "-")
 			newFolder := fmt.Sprintf("%s-%s/", s[0], s[1])
 			recordings = append(recordings, newFolder+name)
@@ -46,7 +49,7 @@ func getAllFiles(folder string) []string {
 
 	var recordings []string
 	for _, f := range files {
-		if f.IsDir() && f.Name() != "deleteme" && f.Name() != "raw" {
+		if f.IsDir() && f.Name()+"/" != raspivid.TrashFolder && f.Name() != "raw" && f.Name() != "continuous" && f.Name()+"/" != raspivid.QuarantineFolder {
 			recordings = append(recordings, getFiles(folder+f.Name())...)
 		}
 	}
@@ -54,8 +57,28 @@ func getAllFiles(folder string) []string {
 	return recordings
 }
 
+// tiers returns the folders recordings may be stored in
+func (rec *RecordingList) tiers() tieredDir {
+	if rec.Archive == "" {
+		return tieredDir{rec.Folder}
+	}
+	return tieredDir{rec.Folder, rec.Archive}
+}
+
 func (rec *RecordingList) handleRecordingList(w http.ResponseWriter, r *http.Request) {
-	out, _ := json.Marshal(getAllFiles(rec.Folder))
+	recordings := getAllFiles(rec.Folder)
+	if _, err := os.Stat(rec.Archive); rec.Archive != "" && err == nil {
+		listed := make(map[string]bool)
+		for _, v := range recordings {
+			listed[v] = true
+		}
+		for _, v := range getAllFiles(rec.Archive) {
+			if !listed[v] {
+				recordings = append(recordings, v)
+			}
+		}
+	}
+	out, _ := json.Marshal(recordings)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(out)
 }
@@ -63,27 +86,38 @@ func (rec *RecordingList) handleRecordingList(w http.ResponseWriter, r *http.Req
 func (rec *RecordingList) handleDeleteRecording(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	videoID := vars["videoID"]
+	if rec.Locks.IsLocked(videoID) {
+		http.Error(w, "recording is locked", http.StatusConflict)
+		return
+	}
+	if rec.recordingPath(videoID) == "" {
+		http.Error(w, "invalid recording name", http.StatusBadRequest)
+		return
+	}
 
-	os.MkdirAll(rec.Folder+"deleteme/", 0777)
+	err := rec.Trash.Discard(videoID)
+	if os.IsNotExist(err) {
+		http.Error(w, "recording not found", http.StatusNotFound)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	s := strings.Split(videoID, "-")
-	newFolder := fmt.Sprintf("%s-%s/", s[0], s[1])
-	os.Rename(rec.Folder+newFolder+videoID+".mp4", rec.Folder+"deleteme/"+videoID+".mp4")
-	os.Rename(rec.Folder+newFolder+videoID+".jpg", rec.Folder+"deleteme/"+videoID+".jpg")
+func (rec *RecordingList) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, rec.Trash.List())
 }
 
-func (rec *RecordingList) handleDestroyRecording(w http.ResponseWriter, r *http.Request) {
-	files, err := os.ReadDir(rec.Folder + "deleteme/")
-	if err != nil {
-		return
+// handleRestoreRecording moves a discarded recording back to its day folder
+func (rec *RecordingList) handleRestoreRecording(w http.ResponseWriter, r *http.Request) {
+	err := rec.Trash.Restore(mux.Vars(r)["videoID"])
+	if os.IsNotExist(err) {
+		http.Error(w, "recording not found in the trash", http.StatusNotFound)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
+}
 
-	for _, f := range files {
-		s := strings.Split(f.Name(), "_")
-
-		videoTime, _ := time.Parse("2006-01-02-1504", s[0])
-		if time.Now().Add(-time.Hour).After(videoTime) {
-			os.Remove(rec.Folder + "deleteme/" + f.Name())
-		}
-	}
+// handleEmptyTrash permanently deletes everything in the trash
+func (rec *RecordingList) handleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, rec.Trash.Purge(0))
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sentry-picam/raspivid"
+)
+
+type RetentionControl struct {
+	Recorder *raspivid.Recorder
+	Folder   string
+}
+
+func (rc *RetentionControl) handleGetRetention(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, rc.Recorder.Retention.Get())
+}
+
+func (rc *RetentionControl) handleSetRetention(w http.ResponseWriter, r *http.Request) {
+	p := raspivid.RetentionPolicy{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := rc.Recorder.Retention.Set(p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	go rc.Recorder.Maintenance(rc.Folder)
+	rc.handleGetRetention(w, r)
+}
+
+// handlePreviewRetention lists what the retention policy would delete now, without deleting it
+func (rc *RetentionControl) handlePreviewRetention(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, rc.Recorder.PreviewRetention(rc.Folder))
+}
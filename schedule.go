@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sentry-picam/raspivid"
+	"time"
+)
+
+type ScheduleControl struct {
+	Recorder *raspivid.Recorder
+}
+
+type scheduleSettings struct {
+	Windows  []raspivid.ScheduleWindow  `json:"windows"`
+	Holidays []raspivid.HolidayOverride `json:"holidays"`
+}
+
+func (sc *ScheduleControl) handleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	settings := scheduleSettings{}
+	settings.Windows, settings.Holidays = sc.Recorder.Schedule.Get()
+
+	out, _ := json.Marshal(settings)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+func (sc *ScheduleControl) handleSetSchedule(w http.ResponseWriter, r *http.Request) {
+	settings := scheduleSettings{}
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := sc.Recorder.Schedule.Set(settings.Windows, settings.Holidays); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sc.handleGetSchedule(w, r)
+}
+
+// handleOverride arms or disarms recording for {"minutes": N}, ignoring the schedule.
+// 0 minutes clears the override.
+func (sc *ScheduleControl) handleOverride(armed bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Minutes int `json:"minutes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Minutes < 0 {
+			http.Error(w, "expected {\"minutes\": N}", http.StatusBadRequest)
+			return
+		}
+
+		sc.Recorder.Schedule.Override(armed, time.Duration(req.Minutes)*time.Minute)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"sentry-picam/raspivid"
+	"strconv"
+)
+
+type SnapshotControl struct {
+	Snapshot *raspivid.Snapshot
+}
+
+// handleSnapshot returns the latest keyframe as a jpg, scaled to ?width=N (default full size)
+// with ?quality=1-100 (default 85)
+func (sc *SnapshotControl) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	width := 0
+	if q.Get("width") != "" {
+		var err error
+		if width, err = strconv.Atoi(q.Get("width")); err != nil || width < 16 || width > 4096 {
+			http.Error(w, "width must be between 16 and 4096", http.StatusBadRequest)
+			return
+		}
+	}
+	quality := 85
+	if q.Get("quality") != "" {
+		var err error
+		if quality, err = strconv.Atoi(q.Get("quality")); err != nil || quality < 1 || quality > 100 {
+			http.Error(w, "quality must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	jpg, taken, err := sc.Snapshot.JPEG(width, quality)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Last-Modified", taken.UTC().Format(http.TimeFormat))
+	w.Write(jpg)
+}
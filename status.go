@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"sentry-picam/raspivid"
+	"time"
 )
 
 type Status struct {
@@ -12,13 +13,23 @@ type Status struct {
 
 func (rec *Status) handleStatus(w http.ResponseWriter, r *http.Request) {
 	var settings struct {
-		RecordingStatus int `json:"isRecording"`
+		RecordingStatus int                      `json:"isRecording"`
+		Armed           bool                     `json:"armed"`
+		OverrideUntil   *time.Time               `json:"overrideUntil,omitempty"`
+		LastRotation    *raspivid.RotationResult `json:"lastRotation,omitempty"`
+		ArchiveRotation *raspivid.RotationResult `json:"archiveRotation,omitempty"`
 	}
 	if rec.Recorder.RequestedRecord {
 		settings.RecordingStatus = 1
 	} else {
 		settings.RecordingStatus = 0
 	}
+	settings.Armed = rec.Recorder.IsArmed()
+	if _, until, ok := rec.Recorder.Schedule.GetOverride(); ok {
+		settings.OverrideUntil = &until
+	}
+	settings.LastRotation = rec.Recorder.LastRotation()
+	settings.ArchiveRotation = rec.Recorder.LastArchiveRotation()
 
 	out, _ := json.Marshal(settings)
 	w.Write(out)
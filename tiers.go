@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// tieredDir serves files from the first of its folders that has them
+type tieredDir []string
+
+func (t tieredDir) Open(name string) (http.File, error) {
+	var err error
+	for _, dir := range t {
+		var f http.File
+		if f, err = http.Dir(dir).Open(name); err == nil {
+			return f, nil
+		}
+	}
+	return nil, err
+}
+
+// path returns the path of a file relative to the recording folder, in the first
+// folder that has it
+func (t tieredDir) path(rel string) string {
+	for _, dir := range t {
+		if _, err := os.Stat(dir + rel); err == nil {
+			return dir + rel
+		}
+	}
+	return t[0] + rel
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sentry-picam/raspivid"
+	"strconv"
+	"time"
+)
+
+const maxTimelineExport = 10 * time.Minute
+
+type TimelineControl struct {
+	Folders tieredDir
+}
+
+type resolvedTime struct {
+	raspivid.Coverage
+	URL    string  `json:"url"`
+	Offset float64 `json:"offset"` // seconds into the file
+}
+
+// handleTimeline returns the recordings and motion of ?date=2006-01-02, default today
+func (tc *TimelineControl) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	date := time.Now()
+	if q := r.URL.Query().Get("date"); q != "" {
+		var err error
+		if date, err = time.ParseInLocation("2006-01-02", q, time.Local); err != nil {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, raspivid.GetTimeline(tc.Folders, date))
+}
+
+// resolve finds the recording covering ?t=, an RFC 3339 timestamp
+func (tc *TimelineControl) resolve(w http.ResponseWriter, r *http.Request) (resolvedTime, bool) {
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("t"))
+	if err != nil {
+		http.Error(w, "t must be an RFC 3339 timestamp", http.StatusBadRequest)
+		return resolvedTime{}, false
+	}
+	c, offset, ok := raspivid.Resolve(tc.Folders, at.Local())
+	if !ok {
+		http.Error(w, "nothing was recorded at "+at.Format(time.RFC3339), http.StatusNotFound)
+		return resolvedTime{}, false
+	}
+	return resolvedTime{c, "/recordings/" + c.File, offset.Seconds()}, true
+}
+
+func (tc *TimelineControl) handleResolve(w http.ResponseWriter, r *http.Request) {
+	if res, ok := tc.resolve(w, r); ok {
+		writeJSON(w, res)
+	}
+}
+
+// handleVideo serves the recording covering ?t= with byte range support, with the offset of
+// t in the X-Offset header. With ?duration=N, N seconds starting at t are exported instead.
+func (tc *TimelineControl) handleVideo(w http.ResponseWriter, r *http.Request) {
+	res, ok := tc.resolve(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query().Get("duration")
+	if q == "" {
+		w.Header().Set("X-Offset", strconv.FormatFloat(res.Offset, 'f', 3, 64))
+		http.ServeFile(w, r, tc.Folders.path(res.File))
+		return
+	}
+
+	seconds, err := strconv.ParseFloat(q, 64)
+	length := time.Duration(seconds * float64(time.Second))
+	if err != nil || length <= 0 || length > maxTimelineExport {
+		http.Error(w, "duration must be between 0 and "+strconv.Itoa(int(maxTimelineExport.Seconds()))+" seconds", http.StatusBadRequest)
+		return
+	}
+	if filepath.Ext(res.File) != ".mp4" {
+		http.Error(w, "only mp4 recordings can be exported", http.StatusConflict)
+		return
+	}
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		http.Error(w, "exporting requires ffmpeg", http.StatusServiceUnavailable)
+		return
+	}
+
+	f, err := os.CreateTemp("", "sentry-picam-*.mp4")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	offset := time.Duration(res.Offset * float64(time.Second))
+	if err := raspivid.Trim(tc.Folders.path(res.File), f.Name(), offset, length, raspivid.TrimOptions{}); err != nil {
+		http.Error(w, "export failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := time.Now().Format("2006-01-02-150405")
+	if at, err := time.Parse(time.RFC3339, r.URL.Query().Get("t")); err == nil {
+		name = at.Local().Format("2006-01-02-150405")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".mp4\"")
+	http.ServeFile(w, r, f.Name())
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sentry-picam/raspivid"
+)
+
+type TripwireControl struct {
+	Motion *raspivid.Motion
+}
+
+type tripwireSettings struct {
+	Cols      int                       `json:"cols"`
+	Rows      int                       `json:"rows"`
+	Tripwires []raspivid.Tripwire       `json:"tripwires"`
+	Counts    map[string]map[string]int `json:"counts"`
+}
+
+func (tc *TripwireControl) handleGetTripwires(w http.ResponseWriter, r *http.Request) {
+	settings := tripwireSettings{}
+	settings.Cols, settings.Rows = tc.Motion.GridSize()
+	settings.Tripwires, settings.Counts = tc.Motion.Tripwires.Get()
+
+	writeJSON(w, settings)
+}
+
+func (tc *TripwireControl) handleSetTripwires(w http.ResponseWriter, r *http.Request) {
+	settings := tripwireSettings{}
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cols, rows := tc.Motion.GridSize()
+	if err := tc.Motion.Tripwires.Set(settings.Tripwires, cols, rows); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tc.handleGetTripwires(w, r)
+}
+
+func (tc *TripwireControl) handleResetCounts(w http.ResponseWriter, r *http.Request) {
+	if err := tc.Motion.Tripwires.ResetCounts(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -21,6 +21,9 @@ func update(folder string) {
 
 			if extension == ".jpg" || extension == ".mp4" {
 				s := strings.Split(f.Name(), "-")
+				if len(s) < 2 {
+					continue
+				}
 				newFolder := fmt.Sprintf("%s/%s-%s/", folder, s[0], s[1])
 				os.MkdirAll(newFolder, 0777)
 				os.Rename(folder+f.Name(), newFolder+f.Name())
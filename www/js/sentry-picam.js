@@ -10,6 +10,7 @@ var SentryPicam = function(canvasID, wsAddress){
     var mctx; // 2d context for the motion canvas
     var coordinateCache = []; // cache to translate indicies to coordinates
     var motionMask = []; // stores areas to mask off
+    var motionZones = []; // named zones with their own sensitivity
     var dispMotionBlockWidth = 0;
     var motionFrameWidth = 0;
     var origBgColor = document.querySelector('body').style.backgroundColor;
@@ -71,6 +72,7 @@ var SentryPicam = function(canvasID, wsAddress){
                 case "string":
                     var inc = JSON.parse(evt.data);
                     motionMask = new Int8Array(inc.mask);
+                    motionZones = inc.zones || [];
                     break;
                 default:
                     frame = new Uint8Array(evt.data);
@@ -121,6 +123,35 @@ var SentryPicam = function(canvasID, wsAddress){
         mctx.stroke();
     }
 
+    function drawZone(zone) {
+        var colors = {record: "lime", notify: "yellow", ignore: "gray"};
+        mctx.beginPath();
+        if(zone.rect) {
+            mctx.rect(zone.rect.x * dispMotionBlockWidth, zone.rect.y * dispMotionBlockWidth,
+                zone.rect.w * dispMotionBlockWidth, zone.rect.h * dispMotionBlockWidth);
+        }
+        else {
+            zone.polygon.forEach(function(p, i) {
+                if(i == 0) {
+                    mctx.moveTo(p.x * dispMotionBlockWidth, p.y * dispMotionBlockWidth);
+                }
+                else {
+                    mctx.lineTo(p.x * dispMotionBlockWidth, p.y * dispMotionBlockWidth);
+                }
+            });
+            mctx.closePath();
+        }
+        mctx.strokeStyle = colors[zone.action] || "lime";
+        mctx.lineWidth = 3;
+        mctx.stroke();
+        mctx.lineWidth = 1;
+
+        var labelAt = zone.rect ? zone.rect : zone.polygon[0];
+        mctx.font = "bold 24px sans-serif";
+        mctx.fillStyle = mctx.strokeStyle;
+        mctx.fillText(zone.name, labelAt.x * dispMotionBlockWidth + 4, labelAt.y * dispMotionBlockWidth + 26);
+    }
+
     function buildCoordinateCache() {
         var x = 0;
         var y = 0;
@@ -222,6 +253,7 @@ var SentryPicam = function(canvasID, wsAddress){
                     drawBoxMask(coordinateCache[i].x, coordinateCache[i].y);
                 }
             });
+            motionZones.forEach(drawZone);
         }
     }
 
@@ -274,6 +306,7 @@ var SentryPicam = function(canvasID, wsAddress){
         getTick: function() { return ticks; },
         set: set,
         setTopOffset: function(offset) { topOffset = offset; },
+        setZones: function(zones) { motionZones = zones; },
         toggleMotionMaskUx: toggleMotionMaskUx
     }
 };
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sentry-picam/raspivid"
+)
+
+type ZoneControl struct {
+	Motion *raspivid.Motion
+}
+
+type zoneSettings struct {
+	Cols  int                   `json:"cols"`
+	Rows  int                   `json:"rows"`
+	Zones []raspivid.MotionZone `json:"zones"`
+}
+
+func (zc *ZoneControl) handleGetZones(w http.ResponseWriter, r *http.Request) {
+	settings := zoneSettings{}
+	settings.Cols, settings.Rows = zc.Motion.GridSize()
+	settings.Zones = zc.Motion.GetZones()
+
+	out, _ := json.Marshal(settings)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+func (zc *ZoneControl) handleSetZones(w http.ResponseWriter, r *http.Request) {
+	settings := zoneSettings{}
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := zc.Motion.SetZones(settings.Zones); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	zc.handleGetZones(w, r)
+}